@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/rivo/tview"
+	"github.com/zmb3/spotify"
+)
+
+// App owns the state shared by the trees, the playlist listener and the Spotify client
+type App struct {
+	tui          *tview.Application
+	client       MusicLibrary
+	logger       *log.Logger
+	playlistChan chan *AddTrackToPlaylist
+
+	// library is the liked tracks and liked their IDs, both kept up to date as tracks are liked and unliked
+	mu      sync.RWMutex
+	library []spotify.SavedTrack
+	liked   map[string]bool
+
+	// artistTree is where liked tracks are highlighted, only touched from the UI goroutine
+	artistTree *tview.TreeView
+	// playlistTree and playlists, its top level nodes with the liked tracks first, are only touched from the UI
+	// goroutine
+	playlistTree *tview.TreeView
+	playlists    []*tview.TreeNode
+	// marks are the tracks marked for changing together, in either tree and in the order they were marked, and
+	// lastMark the one marked last. They're only touched from the UI goroutine.
+	marks    []*tview.TreeNode
+	lastMark *tview.TreeNode
+	// nextPlaylist is the index of the next playlist created, indexes of deleted playlists aren't reused
+	nextPlaylist int
+	// pages, if set, holds the layout and shows popups over it
+	pages *tview.Pages
+	// switchProfile, if set, is called to pick another profile
+	switchProfile func()
+	// likedColor highlights the tracks in library
+	likedColor tcell.Color
+	// market is where tracks are played, the ones that aren't available there are dimmed
+	market string
+	// pinnedPlaylists, by name or ID, get the one key playlist indexes
+	pinnedPlaylists []string
+	// playlistPrefix is the number typed so far of a playlist index like "12c", only touched from the UI goroutine
+	playlistPrefix string
+}
+
+// NewApp creates an App that talks to Spotify through client and logs to logger
+func NewApp(tui *tview.Application, client MusicLibrary, logger *log.Logger) *App {
+	return &App{
+		tui:          tui,
+		client:       client,
+		logger:       logger,
+		playlistChan: make(chan *AddTrackToPlaylist, 100), // so key presses don't wait on the listener
+		liked:        map[string]bool{},
+		likedColor:   tcell.ColorLightBlue,
+	}
+}
+
+// Close stops the playlist listener
+func (a *App) Close() {
+	close(a.playlistChan)
+}
+
+// loadLibrary fetches the liked tracks
+func (a *App) loadLibrary(ctx context.Context, progress func(fetched int, total int)) error {
+	items, err := a.client.getAllSavedTracks(ctx, progress)
+	if err != nil {
+		return err
+	}
+	liked := make(map[string]bool, len(items))
+	for _, item := range items {
+		liked[item.ID.String()] = true
+	}
+	a.mu.Lock()
+	a.library = items
+	a.liked = liked
+	a.mu.Unlock()
+	return nil
+}
+
+// savedTracks returns the liked tracks, the slice is replaced rather than modified so it's safe to range over
+func (a *App) savedTracks() []spotify.SavedTrack {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.library
+}
+
+func (a *App) libraryContains(id spotify.ID) bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.liked[id.String()]
+}
+
+// errNoTrackID is returned for local files and tracks taken off Spotify, they can't be changed by ID
+var errNoTrackID = errors.New("the track has no Spotify ID")
+
+// errRemoved is returned for removing a playlist item that's already been removed
+var errRemoved = errors.New("the track has already been removed")
+
+// addTracks adds tracks to a playlist, or the liked tracks when playlist is "", in as few requests as it can
+func (a *App) addTracks(ctx context.Context, playlist string, tracks []spotify.SavedTrack) error {
+	ids := []string{}
+	for _, track := range tracks {
+		if track.ID == "" {
+			return errNoTrackID
+		}
+		ids = append(ids, track.ID.String())
+	}
+	err := a.client.addTracksToPlaylist(ctx, playlist, ids)
+	if err == nil && playlist == "" {
+		a.setLiked(tracks, nil)
+	}
+	return err
+}
+
+// removeTrack removes a track from a playlist, or the liked tracks when playlist is ""
+func (a *App) removeTrack(ctx context.Context, playlist string, track string) error {
+	if track == "" {
+		return errNoTrackID
+	}
+	err := a.client.removeTrackFromPlaylist(ctx, playlist, track)
+	if err == nil && playlist == "" {
+		a.setLiked(nil, []string{track})
+	}
+	return err
+}
+
+// removeTracks removes tracks from a playlist, or the liked tracks when playlist is "", in as few requests as it can
+func (a *App) removeTracks(ctx context.Context, playlist string, tracks []string) error {
+	err := a.client.removeTracksFromPlaylist(ctx, playlist, tracks)
+	if err == nil && playlist == "" {
+		a.setLiked(nil, tracks)
+	}
+	return err
+}
+
+// trackIDs are the Spotify IDs of track nodes
+func trackIDs(tracks []*Node) []string {
+	ids := []string{}
+	for _, track := range tracks {
+		ids = append(ids, track.ID)
+	}
+	return ids
+}
+
+// savedTrackOf is a track node as it's listed in the liked tracks, liked now. Nodes listed without their track
+// only have its ID and name. It reads the node's Meta, so it's only called from the UI goroutine.
+func savedTrackOf(n *Node) spotify.SavedTrack {
+	track, ok := n.Meta["track"].(spotify.FullTrack)
+	if !ok {
+		track = spotify.FullTrack{SimpleTrack: spotify.SimpleTrack{ID: spotify.ID(n.ID), Name: n.Name, URI: spotify.URI("spotify:track:" + n.ID)}}
+	}
+	return spotify.SavedTrack{AddedAt: time.Now().UTC().Format(spotify.TimestampLayout), FullTrack: track}
+}
+
+// removeFromPlaylist removes the tracks at the nodes' positions in a playlist, leaving any other copies of them
+// there. It's called from the UI goroutine and sends the change in the background, calling done back on the UI
+// goroutine with the nodes removed; those that can't be are left and the error says why.
+func (a *App) removeFromPlaylist(playlist *playlistState, nodes []*Node, done func(removed []*Node, err error)) {
+	if playlist.isLoading() {
+		done(nil, errLoading)
+		return
+	}
+	tracks := []spotify.TrackToRemove{}
+	removed := []*Node{}
+	var skipped error
+	snapshot := ""
+	for _, n := range nodes {
+		uri, _ := n.Meta["uri"].(string)
+		position, current := playlist.position(n)
+		snapshot = current
+		switch {
+		case uri == "":
+			// tracks taken off Spotify come back without one
+			skipped = errNoTrackID
+		case position < 0:
+			skipped = errRemoved
+		default:
+			tracks = append(tracks, spotify.TrackToRemove{URI: uri, Positions: []int{position}})
+			removed = append(removed, n)
+		}
+	}
+	if len(tracks) == 0 {
+		done(nil, skipped)
+		return
+	}
+	if err := playlist.startChange(); err != nil {
+		done(nil, err)
+		return
+	}
+	go func() {
+		snapshot, err := a.client.removeTracksFromPlaylistAt(context.Background(), playlist.id, snapshot, tracks)
+		if err == nil {
+			playlist.removed(snapshot, removed...)
+		}
+		playlist.endChange()
+		a.tui.QueueUpdateDraw(func() {
+			if err != nil {
+				done(nil, err)
+				return
+			}
+			done(removed, skipped)
+		})
+	}()
+}
+
+// showRemoved shows track nodes as removed from where they're listed
+func (a *App) showRemoved(nodes []*Node) {
+	for _, n := range nodes {
+		n.Meta["color"] = tcell.ColorRed
+		if tn := a.treeNodeOf(n); tn != nil {
+			tn.SetColor(tcell.ColorRed)
+		}
+	}
+}
+
+// setLiked lists the liked tracks in library and takes the unliked ones out, and updates their highlighting, which
+// is done on the UI goroutine whichever goroutine it's called from
+func (a *App) setLiked(liked []spotify.SavedTrack, unliked []string) {
+	removed := map[string]bool{}
+	for _, id := range unliked {
+		removed[id] = true
+	}
+	ids := append([]string{}, unliked...)
+	a.mu.Lock()
+	// library is replaced rather than modified, see savedTracks
+	library := make([]spotify.SavedTrack, 0, len(a.library)+len(liked))
+	for _, item := range a.library {
+		if !removed[item.ID.String()] {
+			library = append(library, item)
+		}
+	}
+	for _, id := range unliked {
+		delete(a.liked, id)
+	}
+	for _, item := range liked {
+		if !a.liked[item.ID.String()] {
+			a.liked[item.ID.String()] = true
+			library = append(library, item)
+		}
+		ids = append(ids, item.ID.String())
+	}
+	sort.Sort(bySavedTrack(library))
+	a.library = library
+	a.mu.Unlock()
+	go a.tui.QueueUpdateDraw(func() {
+		for _, track := range ids {
+			// as it is by the time this runs
+			a.colorLikedTrack(track, a.libraryContains(spotify.ID(track)))
+		}
+	})
+}
+
+// colorLikedTrack updates the highlighting of every node for the track in the artist tree
+func (a *App) colorLikedTrack(track string, liked bool) {
+	if a.artistTree == nil {
+		return
+	}
+	a.artistTree.GetRoot().Walk(func(tn, parent *tview.TreeNode) bool {
+		n, ok := tn.GetReference().(*Node)
+		if !ok || n.ID != track || n.ExpandFunc != nil || n.Meta["unavailable"] == true {
+			return true
+		}
+		if liked {
+			if n.Meta == nil {
+				n.Meta = map[string]interface{}{}
+			}
+			n.Meta["color"] = a.likedColor
+			tn.SetColor(a.likedColor)
+		} else if n.Meta != nil {
+			delete(n.Meta, "color")
+			tn.SetColor(tview.Styles.PrimaryTextColor)
+		}
+		return true
+	})
+}
+
+func (a *App) keyBindings(artistTree *tview.TreeView, playlistTree *tview.TreeView) func(key *tcell.EventKey) *tcell.EventKey {
+	return func(key *tcell.EventKey) *tcell.EventKey {
+		if key.Rune() == 'q' {
+			a.tui.Stop()
+			return nil
+		}
+		switch key.Key() {
+		case tcell.KeyCtrlP:
+			if a.switchProfile != nil {
+				a.switchProfile()
+			}
+			return nil
+		case tcell.KeyTab:
+			a.setPlaylistPrefix("")
+			if artistTree.HasFocus() {
+				a.tui.SetFocus(playlistTree)
+			} else {
+				a.tui.SetFocus(artistTree)
+			}
+			return nil
+		}
+		return key
+	}
+}
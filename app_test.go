@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/rivo/tview"
+	"github.com/zmb3/spotify"
+)
+
+// newFixtureApp is an App over the fixture library with the liked tracks loaded
+func newFixtureApp(t *testing.T) (*FakeLibrary, *App) {
+	t.Helper()
+	fake, err := NewFakeLibraryFromFile("fixtures/library.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := NewApp(tview.NewApplication(), fake, log.New(ioutil.Discard, "", 0))
+	if err := a.loadLibrary(context.Background(), nil); err != nil {
+		t.Fatal(err)
+	}
+	return fake, a
+}
+
+func TestLikedTracksAreListedOnceLiked(t *testing.T) {
+	ctx := context.Background()
+	_, a := newFixtureApp(t)
+	track := a.trackToNode(spotify.FullTrack{SimpleTrack: spotify.SimpleTrack{ID: "faketrack00003", Name: "First Light Song 3",
+		Artists: []spotify.SimpleArtist{{Name: "First Light"}}}}, "First Light Song 3", true)
+	if err := a.addTracks(ctx, "", []spotify.SavedTrack{savedTrackOf(track)}); err != nil {
+		t.Fatal(err)
+	}
+	listed := func(id string) *spotify.SavedTrack {
+		for _, item := range a.savedTracks() {
+			if item.ID.String() == id {
+				return &item
+			}
+		}
+		return nil
+	}
+	if item := listed("faketrack00003"); item == nil || artistName(item.Artists) != "First Light" {
+		t.Errorf("expected the liked track to be listed with its artist, got %+v", item)
+	}
+	if !a.libraryContains("faketrack00003") {
+		t.Error("expected the track to be liked")
+	}
+
+	if err := a.removeTracks(ctx, "", []string{track.ID}); err != nil {
+		t.Fatal(err)
+	}
+	if item := listed("faketrack00003"); item != nil {
+		t.Errorf("expected the unliked track not to be listed, got %+v", item)
+	}
+	if a.libraryContains("faketrack00003") {
+		t.Error("expected the track not to be liked")
+	}
+}
+
+// runFixtureTUI runs the trees over the fixture library on a simulated screen until the test ends
+func runFixtureTUI(t *testing.T) (*FakeLibrary, *App) {
+	t.Helper()
+	fake, a := newFixtureApp(t)
+	screen := tcell.NewSimulationScreen("UTF-8")
+	if err := screen.Init(); err != nil {
+		t.Fatal(err)
+	}
+	screen.SetSize(120, 40)
+	a.tui.SetScreen(screen)
+	playlistTree := a.buildPlaylistTree()
+	artistTree := a.buildArtistTree()
+	layout := tview.NewFlex().AddItem(artistTree, 0, 1, true).AddItem(playlistTree, 0, 1, false)
+	a.tui.SetRoot(layout, true).SetInputCapture(a.keyBindings(artistTree, playlistTree))
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		if err := a.tui.Run(); err != nil {
+			t.Error(err)
+		}
+	}()
+	t.Cleanup(func() {
+		a.tui.Stop()
+		<-stopped
+		a.Close()
+	})
+	return fake, a
+}
+
+// onUI runs f on the UI goroutine and waits for it
+func onUI(a *App, f func()) {
+	a.tui.QueueUpdateDraw(f)
+}
+
+// waitFor waits until done, checked on the UI goroutine, is true
+func waitFor(t *testing.T, a *App, what string, done func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		ok := false
+		onUI(a, func() {
+			ok = done()
+		})
+		if ok {
+			return
+		}
+	}
+	t.Fatalf("timed out waiting for %s", what)
+}
+
+// expand selects tn and expands it, waiting for its children
+func expand(t *testing.T, a *App, tree *tview.TreeView, tn *tview.TreeNode) {
+	t.Helper()
+	onUI(a, func() {
+		tree.SetCurrentNode(tn)
+		tree.GetInputCapture()(tcell.NewEventKey(tcell.KeyRight, 0, tcell.ModNone))
+	})
+	waitFor(t, a, "the children of "+tn.GetText(), func() bool {
+		return len(tn.GetChildren()) > 0 && !isLoading(tn)
+	})
+}
+
+func TestPlaylistChangesAreSentInTheBackground(t *testing.T) {
+	fake, a := runFixtureTUI(t)
+	var roadTrip *tview.TreeNode
+	onUI(a, func() {
+		roadTrip = a.playlists[1]
+		roadTrip.GetReference().(*Node).Meta["playlist"].(*playlistState).toggleOrder()
+	})
+	expand(t, a, a.playlistTree, roadTrip)
+
+	// the second track moves to the top, the first one follows it
+	onUI(a, func() {
+		second := roadTrip.GetChildren()[1].GetReference().(*Node)
+		a.moveTracks(second, moveUpKey)
+	})
+	waitFor(t, a, "the track to move", func() bool {
+		return roadTrip.GetChildren()[0].GetReference().(*Node).ID == "faketrack00015"
+	})
+	items, _ := fake.getAllSongsByPlaylist(context.Background(), "fakeplaylist001", nil)
+	if items[0].Track.ID != "faketrack00015" || items[1].Track.ID != "faketrack00002" {
+		t.Errorf("expected the track to be moved up in the playlist, got %s, %s", items[0].Track.ID, items[1].Track.ID)
+	}
+
+	onUI(a, func() {
+		a.createPlaylist(playlistDetails{Name: "New", Access: accessPrivate})
+	})
+	waitFor(t, a, "the new playlist", func() bool {
+		return a.playlists[len(a.playlists)-1].GetReference().(*Node).Label == playlistIndex(len(a.playlists)-1)+") New"
+	})
+	onUI(a, func() {
+		a.deletePlaylist(roadTrip)
+	})
+	waitFor(t, a, "the playlist to be deleted", func() bool {
+		return a.playlistTreeNodeOf(roadTrip.GetReference().(*Node).Meta["playlist"].(*playlistState)) == nil
+	})
+	playlists, _ := fake.getAllPlaylistsForUser(context.Background())
+	names := []string{}
+	for _, item := range playlists {
+		names = append(names, item.Name)
+	}
+	if len(names) != 2 || names[0] != "Rainy Day" || names[1] != "New" {
+		t.Errorf("expected Road Trip to be replaced by New, got %q", names)
+	}
+}
+
+// childTexts is the text of each of tn's children
+func childTexts(tn *tview.TreeNode) []string {
+	texts := []string{}
+	for _, child := range tn.GetChildren() {
+		texts = append(texts, child.GetText())
+	}
+	return texts
+}
+
+// childNamed is the child of tn with the text, failing the test if there isn't one
+func childNamed(t *testing.T, tn *tview.TreeNode, text string) *tview.TreeNode {
+	t.Helper()
+	for _, child := range tn.GetChildren() {
+		if child.GetText() == text {
+			return child
+		}
+	}
+	t.Fatalf("expected %q under %s, got %q", text, tn.GetText(), childTexts(tn))
+	return nil
+}
+
+func TestExpandingAnArtistAndAPlaylist(t *testing.T) {
+	_, a := runFixtureTUI(t)
+	var artists, roadTrip *tview.TreeNode
+	onUI(a, func() {
+		artists = a.artistTree.GetRoot()
+		roadTrip = a.playlists[1]
+	})
+	artist := childNamed(t, artists, "The Lanterns")
+	expand(t, a, a.artistTree, artist)
+	albums := childNamed(t, artist, "Albums")
+	expand(t, a, a.artistTree, albums)
+	album := childNamed(t, albums, "First Light - (2015-03-02)")
+	childNamed(t, albums, "Single Spark - (2020-05-01) (single)")
+	expand(t, a, a.artistTree, album)
+	tracks := album.GetChildren()
+	if len(tracks) != 4 || tracks[0].GetText() != " 1 - First Light Song 1" {
+		t.Errorf("expected the album's 4 tracks, got %q", childTexts(album))
+	} else if tracks[0].GetColor() != a.likedColor || tracks[1].GetColor() == a.likedColor {
+		t.Error("expected only the liked track of the album to be highlighted")
+	}
+
+	expand(t, a, a.playlistTree, roadTrip)
+	items := childTexts(roadTrip)
+	if len(items) != 5 {
+		t.Errorf("expected Road Trip's 5 tracks, got %q", items)
+	}
+	childNamed(t, roadTrip, "Marigold Echo - Northbound Song 2")
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"strings"
 
@@ -9,27 +10,27 @@ import (
 	"github.com/zmb3/spotify"
 )
 
-func listArtistCategories(n *Node) ([]*Node, error) {
-	popularTracksNode := &Node{Label: "Popular Tracks", ID: n.ID, ExpandFunc: listPopularTracks}
-	albumsNode := &Node{Label: "Albums", ID: n.ID, ExpandFunc: listAlbums}
-	relatedArtistsNode := &Node{Label: "Related Artists", ID: n.ID, ExpandFunc: listRelatedArtists}
+func (a *App) listArtistCategories(ctx context.Context, n *Node, partial func(children []*Node)) ([]*Node, error) {
+	popularTracksNode := &Node{Label: "Popular Tracks", ID: n.ID, ExpandFunc: a.listPopularTracks}
+	albumsNode := &Node{Label: "Albums", ID: n.ID, ExpandFunc: a.listAlbums}
+	relatedArtistsNode := &Node{Label: "Related Artists", ID: n.ID, ExpandFunc: a.listRelatedArtists}
 	return []*Node{popularTracksNode, albumsNode, relatedArtistsNode}, nil
 }
 
-func listRelatedArtists(n *Node) ([]*Node, error) {
-	items, err := spoqClient.getRelatedArtists(n.ID)
+func (a *App) listRelatedArtists(ctx context.Context, n *Node, partial func(children []*Node)) ([]*Node, error) {
+	items, err := a.client.getRelatedArtists(ctx, n.ID)
 	if err != nil {
 		return nil, err
 	}
 	result := []*Node{}
 	for _, item := range items {
-		result = append(result, &Node{Name: item.Name, Label: item.Name, ID: item.ID.String(), ExpandFunc: listArtistCategories})
+		result = append(result, &Node{Name: item.Name, Label: item.Name, ID: item.ID.String(), ExpandFunc: a.listArtistCategories})
 	}
 	return result, nil
 }
 
-func listAlbums(n *Node) ([]*Node, error) {
-	items, err := spoqClient.getAllAlbumsByArtist(n.ID)
+func (a *App) listAlbums(ctx context.Context, n *Node, partial func(children []*Node)) ([]*Node, error) {
+	items, err := a.client.getAllAlbumsByArtist(ctx, n.ID)
 	if err != nil {
 		return nil, err
 	}
@@ -39,69 +40,112 @@ func listAlbums(n *Node) ([]*Node, error) {
 		if item.AlbumType != "album" {
 			label = fmt.Sprintf("%s (%s)", label, item.AlbumType)
 		}
-		result = append(result, &Node{Name: item.Name, Label: label, ID: item.ID.String(), ExpandFunc: listTracks})
+		result = append(result, &Node{Name: item.Name, Label: label, ID: item.ID.String(), ExpandFunc: a.listTracks})
 	}
 	return result, nil
 }
 
-func simpleTrackToNode(item spotify.SimpleTrack, label string) *Node {
-	node := &Node{Name: item.Name, Label: label, ID: item.ID.String(), KeyPressFunc: trackKeyPress}
-	if libraryContains(item.ID) {
-		node.Meta = map[string]interface{}{"color": tcell.ColorLightBlue}
+// trackToNode is a track in the ARTISTS tree, the track is kept for listing it in the liked tracks once it's liked
+func (a *App) trackToNode(item spotify.FullTrack, label string, playable bool) *Node {
+	node := &Node{Name: item.Name, Label: label, ID: item.ID.String(), KeyPressFunc: a.trackKeyPress}
+	node.Meta = map[string]interface{}{"track": item}
+	if !playable {
+		dimUnavailable(node)
+	} else if a.libraryContains(item.ID) {
+		node.Meta["color"] = a.likedColor
 	}
 	return node
 }
 
-func listPopularTracks(n *Node) ([]*Node, error) {
-	items, err := spoqClient.getPopularTracks(n.ID)
+func (a *App) listPopularTracks(ctx context.Context, n *Node, partial func(children []*Node)) ([]*Node, error) {
+	items, err := a.client.getPopularTracks(ctx, n.ID)
 	if err != nil {
 		return nil, err
 	}
 	result := []*Node{}
 	for _, item := range items {
-		result = append(result, simpleTrackToNode(item.SimpleTrack, fmt.Sprintf("%s - %s", item.Name, item.Album.Name)))
+		result = append(result, a.trackToNode(item, fmt.Sprintf("%s - %s", item.Name, item.Album.Name),
+			playable(a.market, item.IsPlayable, item.AvailableMarkets)))
 	}
 	return result, nil
 }
 
-func listTracks(n *Node) ([]*Node, error) {
-	items, err := spoqClient.getAllSongsByAlbum(n.ID)
+func (a *App) listTracks(ctx context.Context, n *Node, partial func(children []*Node)) ([]*Node, error) {
+	items, err := a.client.getAllSongsByAlbum(ctx, n.ID)
 	if err != nil {
 		return nil, err
 	}
+	album := spotify.SimpleAlbum{ID: spotify.ID(n.ID), Name: n.Name}
 	result := []*Node{}
 	for _, item := range items {
-		result = append(result, simpleTrackToNode(item, fmt.Sprintf("%2d - %s", item.TrackNumber, item.Name)))
+		result = append(result, a.trackToNode(spotify.FullTrack{SimpleTrack: item, Album: album}, fmt.Sprintf("%2d - %s", item.TrackNumber, item.Name),
+			playable(a.market, nil, item.AvailableMarkets)))
 	}
 	return result, nil
 }
 
-func listArtists(n *Node) ([]*Node, error) {
-	items, err := spoqClient.getAllFollowedArtists()
+func (a *App) listArtists(ctx context.Context, n *Node, partial func(children []*Node)) ([]*Node, error) {
+	items, err := a.client.getAllFollowedArtists(ctx)
 	if err != nil {
 		return nil, err
 	}
 	result := []*Node{}
 	for _, item := range items {
-		result = append(result, &Node{Name: strings.TrimPrefix(item.Name, "The "), Label: item.Name, ID: item.ID.String(), ExpandFunc: listArtistCategories})
+		result = append(result, &Node{Name: strings.TrimPrefix(item.Name, "The "), Label: item.Name, ID: item.ID.String(), ExpandFunc: a.listArtistCategories})
 	}
 	return result, nil
 }
 
-func trackKeyPress(n *Node, k string) {
-	playlistChan <- &AddTrackToPlaylist{Track: n, PlaylistIndex: k}
+func (a *App) trackKeyPress(n *Node, k string) {
+	if k == playlistPickerKey {
+		a.setPlaylistPrefix("")
+		a.showPlaylistPicker(a.markedTracks(n), false)
+		return
+	}
+	if k >= "0" && k <= "9" {
+		// the start of a playlist index past the one key ones, see playlistIndex
+		a.setPlaylistPrefix(a.playlistPrefix + k)
+		return
+	}
+	index := a.playlistPrefix + k
+	a.setPlaylistPrefix("")
+	// the marked tracks if there are any
+	tracks := a.markedTracks(n)
+	a.clearMarks()
+	if len(tracks) == 0 {
+		return
+	}
+	a.playlistChan <- &AddTrackToPlaylist{Tracks: tracks, PlaylistIndexes: []string{index}}
+}
+
+// setPlaylistPrefix sets the number typed so far of a playlist index, showing it in the ARTISTS title while it's
+// pending
+func (a *App) setPlaylistPrefix(prefix string) {
+	if prefix == a.playlistPrefix {
+		return
+	}
+	a.playlistPrefix = prefix
+	if a.artistTree == nil {
+		return
+	}
+	if prefix == "" {
+		a.artistTree.SetTitle("ARTISTS")
+	} else {
+		a.artistTree.SetTitle("ARTISTS - add to playlist " + prefix + "…")
+	}
 }
 
-func buildArtistTree() *tview.TreeView {
-	rootNode := &Node{Label: "Followed Artists", ExpandFunc: listArtists}
+func (a *App) buildArtistTree() *tview.TreeView {
+	rootNode := &Node{Label: "Followed Artists", ExpandFunc: a.listArtists}
 	treeRoot := tview.NewTreeNode(rootNode.Label).SetReference(rootNode).SetColor(tcell.ColorGreenYellow).SetSelectable(false)
 	tree := tview.NewTreeView().SetRoot(treeRoot).SetCurrentNode(treeRoot)
 	tree.SetBorder(true).SetTitle("ARTISTS")
-	artists, _ := listArtists(rootNode)
+	artists, _ := a.listArtists(context.Background(), rootNode, nil)
 	for _, artist := range artists {
 		artist.Level = 1 // sort of a hack to determine if we're at the top level
 		treeRoot.AddChild(tview.NewTreeNode(artist.Label).SetReference(artist).SetSelectable(true))
 	}
-	tree.SetInputCapture(treeKeyBindings(tree))
+	tree.SetInputCapture(a.treeKeyBindings(tree))
+	a.artistTree = tree
 	return tree
 }
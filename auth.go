@@ -1,13 +1,25 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"log"
 	"math/rand"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/zmb3/spotify"
@@ -16,52 +28,133 @@ import (
 
 const letterBytes = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ123456789_"
 
+const (
+	spotifyAPIURL      = "https://api.spotify.com/v1/"
+	spotifyAccountsURL = "https://accounts.spotify.com"
+)
+
 func init() {
 	rand.Seed(time.Now().UnixNano())
 }
 
 // SpotifyClientBuilderConfig is the configuration that ClientBuilder uses to initialize a Spotify client
 type SpotifyClientBuilderConfig struct {
-	ClientID     string
+	ClientID string
+	// ClientSecret is optional, without it the app authenticates as a public client using PKCE alone
 	ClientSecret string
 	Scopes       []string
-	LocalPort    string
-	TokenFile    string
+	// LocalPort is where the login callback is served on 127.0.0.1, "" or "0" picks a free port
+	LocalPort string
+	// LoginTimeout is how long to wait for the user to log in, 0 waits forever
+	LoginTimeout time.Duration
+	// TokenFile is where the token is kept as plain JSON when no TokenStore is given
+	TokenFile string
+	// TokenStore keeps the token between runs
+	TokenStore TokenStore
+	// APIURL overrides the Spotify Web API base URL, e.g. to point at a StubServer
+	APIURL string
+	// AccountsURL overrides the Spotify Accounts service base URL used for the /authorize and /api/token endpoints
+	AccountsURL string
+	// OpenURL, if set, is called with the login URL instead of waiting for the user to visit it
+	OpenURL func(url string) error
+	// MaxInFlight caps the number of concurrent requests to Spotify
+	MaxInFlight int
+	// OnThrottle, if set, is told when requests are being rate limited or retried
+	OnThrottle func(message string)
+	// OnTokenSaveError, if set, is told when a refreshed token couldn't be saved
+	OnTokenSaveError func(err error)
+}
+
+// TokenStore keeps the OAuth token between runs
+type TokenStore interface {
+	// Load returns the saved token, or nil if there isn't one
+	Load() (*oauth2.Token, error)
+	Save(tok *oauth2.Token) error
 }
 
 // SpotifyClientBuilder builds an authenticated Spotify client
 type SpotifyClientBuilder struct {
 	Config *SpotifyClientBuilderConfig
-	auth   spotify.Authenticator
+	store  TokenStore
+	auth   *oauth2.Config
+	ctx    context.Context
 	state  string
-	ch     chan *spotify.Client
+	// verifier is the PKCE code verifier for the login in progress
+	verifier string
+	ch       chan loginResult
+	// httpClient is the authenticated client under the last Spotify client built
+	httpClient *http.Client
+}
+
+// loginResult is what the callback handler hands back to GetClient
+type loginResult struct {
+	client *spotify.Client
+	err    error
+}
+
+// DefaultSpotifyClientBuilderConfig is the configuration used when NewSpotifyClientBuilder is not given one
+func DefaultSpotifyClientBuilderConfig() *SpotifyClientBuilderConfig {
+	return &SpotifyClientBuilderConfig{
+		Scopes: []string{spotify.ScopeUserFollowRead,
+			spotify.ScopeUserLibraryRead, spotify.ScopeUserLibraryModify,
+			spotify.ScopePlaylistReadPrivate, spotify.ScopePlaylistModifyPrivate,
+			spotify.ScopePlaylistReadCollaborative, spotify.ScopePlaylistModifyPublic,
+			spotify.ScopeUserReadPrivate,
+		},
+		LocalPort:    "8080",
+		LoginTimeout: 5 * time.Minute,
+		TokenFile:    "token.json",
+		MaxInFlight:  8,
+	}
 }
 
 // NewSpotifyClientBuilder creates a new ClientBuilder with optional config
 func NewSpotifyClientBuilder(config *SpotifyClientBuilderConfig) *SpotifyClientBuilder {
 	c := &SpotifyClientBuilder{}
 	if config == nil {
-		c.Config = &SpotifyClientBuilderConfig{
-			Scopes: []string{spotify.ScopeUserFollowRead,
-				spotify.ScopeUserLibraryRead, spotify.ScopeUserLibraryModify,
-				spotify.ScopePlaylistReadPrivate, spotify.ScopePlaylistModifyPrivate,
-				spotify.ScopePlaylistReadCollaborative, spotify.ScopePlaylistModifyPublic,
-				spotify.ScopeUserReadPrivate,
-			},
-			LocalPort: "8080",
-			TokenFile: "token.json",
-		}
+		c.Config = DefaultSpotifyClientBuilderConfig()
 	} else {
 		c.Config = config
 	}
-	c.auth = spotify.NewAuthenticator(fmt.Sprintf("http://localhost:%s/callback", c.Config.LocalPort), c.Config.Scopes...)
-	// ClientID:     os.Getenv("SPOTIFY_ID"),
-	// ClientSecret: os.Getenv("SPOTIFY_SECRET")
-	if c.Config.ClientID != "" && c.Config.ClientSecret != "" {
-		c.auth.SetAuthInfo(c.Config.ClientID, c.Config.ClientSecret)
+	accountsURL := spotifyAccountsURL
+	if c.Config.AccountsURL != "" {
+		accountsURL = strings.TrimSuffix(c.Config.AccountsURL, "/")
+	}
+	c.auth = &oauth2.Config{
+		ClientID:     os.Getenv("SPOTIFY_ID"),
+		ClientSecret: os.Getenv("SPOTIFY_SECRET"),
+		RedirectURL:  redirectURL(c.Config.LocalPort),
+		Scopes:       c.Config.Scopes,
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  accountsURL + "/authorize",
+			TokenURL: accountsURL + "/api/token",
+		},
+	}
+	if c.Config.ClientID != "" {
+		c.auth.ClientID = c.Config.ClientID
+		c.auth.ClientSecret = c.Config.ClientSecret
+	}
+	if c.auth.ClientSecret == "" {
+		// a public client sends its client_id in the body, both for the code exchange and refreshes
+		c.auth.Endpoint.AuthStyle = oauth2.AuthStyleInParams
+	}
+	// disable HTTP/2 like spotify.NewAuthenticator does, see: https://github.com/zmb3/spotify/issues/20
+	var transport http.RoundTripper = &http.Transport{
+		TLSNextProto: map[string]func(authority string, c *tls.Conn) http.RoundTripper{},
+	}
+	if c.Config.MaxInFlight > 0 {
+		transport = newRetryTransport(transport, c.Config.MaxInFlight, c.Config.OnThrottle)
+	}
+	if c.Config.APIURL != "" {
+		transport = &baseURLTransport{base: transport, from: spotifyAPIURL, to: c.Config.APIURL}
+	}
+	c.ctx = context.WithValue(context.Background(), oauth2.HTTPClient, &http.Client{Transport: transport})
+	c.store = c.Config.TokenStore
+	if c.store == nil {
+		c.store = &fileTokenStore{path: c.Config.TokenFile}
 	}
 	c.state = randStringBytes(40)
-	c.ch = make(chan *spotify.Client)
+	c.ch = make(chan loginResult, 1)
 	return c
 }
 
@@ -72,82 +165,273 @@ func (c *SpotifyClientBuilder) GetClientWithJSONToken(jsonToken []byte) (*spotif
 	if err != nil {
 		return nil, err
 	}
-	client := c.auth.NewClient(&tok)
-	return &client, nil
+	return c.newClient(&tok), nil
 }
 
-// GetClient uses the oauth2 flow to get an authenticated Spotify client
+// GetClient uses the saved token, or the oauth2 flow if there isn't one, to get an authenticated Spotify client
 func (c *SpotifyClientBuilder) GetClient() (*spotify.Client, error) {
-	// try to get from file first
-	client, err := c.getClientWithTokenFile()
+	// try the token store first
+	tok, err := c.store.Load()
+	if err != nil {
+		return nil, fmt.Errorf("unable to load token: %v", err)
+	}
+	if tok != nil {
+		return c.newClient(tok), nil
+	}
+	return c.Login()
+}
+
+// Login uses the oauth2 flow to get an authenticated Spotify client, serving the callback locally
+func (c *SpotifyClientBuilder) Login() (*spotify.Client, error) {
+	err := c.startLogin()
 	if err != nil {
 		return nil, err
 	}
-	if client != nil {
-		return client, nil
+	// start an HTTP server for the callback and initiate an oidc flow
+	port := c.Config.LocalPort
+	if port == "" {
+		port = "0"
+	}
+	listener, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", port))
+	if err != nil {
+		return nil, fmt.Errorf("unable to listen for the login callback: %v", err)
 	}
-	// start an HTTP server and initiate an oidc flow
-	http.HandleFunc("/callback", c.completeAuth)
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+	c.auth.RedirectURL = redirectURL(strconv.Itoa(listener.Addr().(*net.TCPAddr).Port))
+	mux := http.NewServeMux()
+	mux.HandleFunc("/callback", c.completeAuth)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		log.Println("Got request for:", r.URL.String())
+		http.NotFound(w, r)
 	})
-	go http.ListenAndServe(":8080", nil)
-	url := c.auth.AuthURL(c.state)
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go server.Serve(listener)
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+	}()
+
+	url := c.authCodeURL()
 	fmt.Println("Please log in to Spotify by visiting the following page in your browser:", url)
+	if c.Config.OpenURL != nil {
+		go func() {
+			if err := c.Config.OpenURL(url); err != nil {
+				log.Println(err)
+			}
+		}()
+	}
 	// wait for auth to complete
-	client = <-c.ch
-	return client, nil
+	var timeout <-chan time.Time
+	if c.Config.LoginTimeout > 0 {
+		timer := time.NewTimer(c.Config.LoginTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case result := <-c.ch:
+		return result.client, result.err
+	case <-timeout:
+		return nil, fmt.Errorf("timed out after %v waiting for Spotify login", c.Config.LoginTimeout)
+	}
 }
 
-// SaveToken serializes the oauth2 token to file
+// SaveToken saves the client's oauth2 token to the token store
 func (c *SpotifyClientBuilder) SaveToken(client *spotify.Client) error {
 	tok, err := client.Token()
 	if err != nil {
 		return fmt.Errorf("unable to get token from client: %v", err)
 	}
-	tokb, err := json.Marshal(tok)
+	err = c.store.Save(tok)
 	if err != nil {
-		return fmt.Errorf("unable to serialize token: %v", err)
+		return fmt.Errorf("unable to save token: %v", err)
+	}
+	return nil
+}
+
+// LoginWithPastedURL uses the oauth2 flow without a local callback server, for when the browser runs on another
+// machine: the user logs in, then pastes the URL the browser was redirected to (which fails to load) into in
+func (c *SpotifyClientBuilder) LoginWithPastedURL(in io.Reader, out io.Writer) (*spotify.Client, error) {
+	if c.Config.LocalPort == "" || c.Config.LocalPort == "0" {
+		return nil, errors.New("logging in without a browser needs a fixed LocalPort matching the app's redirect URI")
 	}
-	err = ioutil.WriteFile(c.Config.TokenFile, tokb, os.ModePerm)
+	err := c.startLogin()
 	if err != nil {
-		return fmt.Errorf("unable to save token: %v", err)
+		return nil, err
+	}
+	fmt.Fprintln(out, "Please log in to Spotify by visiting the following page in a browser:", c.authCodeURL())
+	fmt.Fprintln(out, "Your browser is then sent to a page that doesn't load. Paste its full URL here:")
+	line, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && line == "" {
+		return nil, fmt.Errorf("unable to read redirect URL: %v", err)
+	}
+	redirected, err := url.Parse(strings.TrimSpace(line))
+	if err != nil {
+		return nil, fmt.Errorf("invalid redirect URL: %v", err)
+	}
+	return c.completeLogin(redirected.Query())
+}
+
+// startLogin prepares the state shared by both ways of logging in
+func (c *SpotifyClientBuilder) startLogin() error {
+	if c.auth.ClientID == "" {
+		return errors.New("no Spotify client ID, set SPOTIFY_ID")
+	}
+	var err error
+	c.verifier, err = newCodeVerifier()
+	if err != nil {
+		return fmt.Errorf("unable to create PKCE code verifier: %v", err)
 	}
 	return nil
 }
 
-func (c *SpotifyClientBuilder) completeAuth(w http.ResponseWriter, r *http.Request) {
-	tok, err := c.auth.Token(c.state, r)
+func (c *SpotifyClientBuilder) authCodeURL() string {
+	return c.auth.AuthCodeURL(c.state,
+		oauth2.SetAuthURLParam("code_challenge", codeChallenge(c.verifier)),
+		oauth2.SetAuthURLParam("code_challenge_method", "S256"))
+}
+
+var errStateMismatch = errors.New("spotify: state mismatch, the redirect is not from this login")
+
+// completeLogin checks the redirect's state, exchanges its code and saves the token
+func (c *SpotifyClientBuilder) completeLogin(values url.Values) (*spotify.Client, error) {
+	if values.Get("state") != c.state {
+		return nil, errStateMismatch
+	}
+	tok, err := c.token(values)
 	if err != nil {
-		http.Error(w, "Couldn't get token", http.StatusForbidden)
-		log.Fatal(err)
+		return nil, err
 	}
-	if st := r.FormValue("state"); st != c.state {
+	// use the token to get an authenticated client
+	client := c.newClient(tok)
+	err = c.SaveToken(client)
+	if err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+func (c *SpotifyClientBuilder) completeAuth(w http.ResponseWriter, r *http.Request) {
+	client, err := c.completeLogin(r.URL.Query())
+	if err == errStateMismatch {
+		// not the login we started, keep waiting for the right one
 		http.NotFound(w, r)
-		log.Fatalf("State mismatch: %s != %s\n", st, c.state)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Couldn't get token", http.StatusForbidden)
+		c.finishLogin(nil, err)
+		return
 	}
-	// use the token to get an authenticated client
-	client := c.auth.NewClient(tok)
-	c.SaveToken(&client)
 	fmt.Fprintf(w, "Login Completed!")
-	c.ch <- &client
+	c.finishLogin(client, nil)
+}
+
+// finishLogin hands the result to GetClient, only the first result counts
+func (c *SpotifyClientBuilder) finishLogin(client *spotify.Client, err error) {
+	select {
+	case c.ch <- loginResult{client: client, err: err}:
+	default:
+	}
+}
+
+// token exchanges the authorization code in the callback query for an oauth2 token
+func (c *SpotifyClientBuilder) token(values url.Values) (*oauth2.Token, error) {
+	if e := values.Get("error"); e != "" {
+		return nil, errors.New("spotify: auth failed - " + e)
+	}
+	code := values.Get("code")
+	if code == "" {
+		return nil, errors.New("spotify: didn't get access code")
+	}
+	return c.auth.Exchange(c.ctx, code, oauth2.SetAuthURLParam("code_verifier", c.verifier))
 }
 
-func (c *SpotifyClientBuilder) getClientWithTokenFile() (*spotify.Client, error) {
-	_, err := os.Stat(c.Config.TokenFile)
-	if os.IsNotExist(err) {
-		log.Printf("Token file %s does not exist\n", c.Config.TokenFile)
-		return nil, nil
+func (c *SpotifyClientBuilder) newClient(tok *oauth2.Token) *spotify.Client {
+	src := &persistingTokenSource{
+		base:    c.auth.TokenSource(c.ctx, tok),
+		store:   c.store,
+		onError: c.Config.OnTokenSaveError,
+		last:    tok.AccessToken,
 	}
-	f, err := os.Open(c.Config.TokenFile)
+	c.httpClient = oauth2.NewClient(c.ctx, oauth2.ReuseTokenSource(tok, src))
+	client := spotify.NewClient(c.httpClient)
+	return &client
+}
+
+// HTTPClient is the authenticated client under the last Spotify client built, for requests zmb3/spotify can't make
+func (c *SpotifyClientBuilder) HTTPClient() *http.Client {
+	return c.httpClient
+}
+
+// persistingTokenSource saves the token to the store every time the underlying source refreshes it,
+// so a crash or kill doesn't lose a rotated refresh token
+type persistingTokenSource struct {
+	base    oauth2.TokenSource
+	store   TokenStore
+	onError func(err error)
+
+	mu   sync.Mutex
+	last string // access token last written
+}
+
+func (s *persistingTokenSource) Token() (*oauth2.Token, error) {
+	tok, err := s.base.Token()
 	if err != nil {
 		return nil, err
 	}
-	jsonToken, err := ioutil.ReadAll(f)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if tok.AccessToken != s.last {
+		if err := s.store.Save(tok); err != nil {
+			if s.onError != nil {
+				s.onError(err)
+			}
+		} else {
+			s.last = tok.AccessToken
+		}
+	}
+	return tok, nil
+}
+
+// baseURLTransport sends requests for one base URL to another, leaving all other requests untouched
+type baseURLTransport struct {
+	base http.RoundTripper
+	from string
+	to   string
+}
+
+func (t *baseURLTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !strings.HasPrefix(req.URL.String(), t.from) {
+		return t.base.RoundTrip(req)
+	}
+	u, err := url.Parse(strings.TrimSuffix(t.to, "/") + "/" + strings.TrimPrefix(req.URL.String(), t.from))
 	if err != nil {
 		return nil, err
 	}
-	return c.GetClientWithJSONToken(jsonToken)
+	req = req.Clone(req.Context())
+	req.URL = u
+	req.Host = u.Host
+	return t.base.RoundTrip(req)
+}
+
+// newCodeVerifier creates a PKCE code verifier, 43 characters from the unreserved set (RFC 7636)
+func newCodeVerifier() (string, error) {
+	b := make([]byte, 32)
+	if _, err := crand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// codeChallenge is the S256 PKCE challenge for a code verifier
+func codeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// redirectURL is the login callback on the loopback address, which Spotify allows over plain http
+func redirectURL(port string) string {
+	return fmt.Sprintf("http://127.0.0.1:%s/callback", port)
 }
 
 func randStringBytes(n int) string {
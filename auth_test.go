@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoginWithPKCE(t *testing.T) {
+	_, config := newStubClientConfig(t)
+	client, err := NewSpotifyClientBuilder(config).GetClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tok, err := config.TokenStore.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tok == nil || tok.AccessToken == "" || tok.RefreshToken == "" {
+		t.Fatalf("expected the login to save a token, got %+v", tok)
+	}
+	if _, err := client.CurrentUser(); err != nil {
+		t.Errorf("expected the new token to be accepted, got %v", err)
+	}
+}
+
+func TestLoginRejectsTheWrongCodeVerifier(t *testing.T) {
+	_, config := newStubClientConfig(t)
+	builder := NewSpotifyClientBuilder(config)
+	if err := builder.startLogin(); err != nil {
+		t.Fatal(err)
+	}
+	// the stub authorizes straight away, the redirect back carries the code
+	noRedirects := &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := noRedirects.Get(builder.authCodeURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	redirected, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if redirected.Query().Get("code") == "" {
+		t.Fatalf("expected a code in the redirect, got %s", redirected)
+	}
+
+	// a verifier from another login
+	builder.verifier, err = newCodeVerifier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = builder.completeLogin(redirected.Query())
+	if err == nil || !strings.Contains(err.Error(), "invalid_grant") {
+		t.Errorf("expected the code exchange to be rejected with invalid_grant, got %v", err)
+	}
+	if tok, _ := config.TokenStore.Load(); tok != nil {
+		t.Errorf("expected no token to be saved, got %+v", tok)
+	}
+}
+
+func TestExpiredTokenIsRefreshedAndSaved(t *testing.T) {
+	_, config := newStubClientConfig(t)
+	if _, err := NewSpotifyClientBuilder(config).GetClient(); err != nil {
+		t.Fatal(err)
+	}
+	tok, _ := config.TokenStore.Load()
+	tok.Expiry = time.Now().Add(-time.Minute)
+	if err := config.TokenStore.Save(tok); err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := NewSpotifyClientBuilder(config).GetClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.CurrentUser(); err != nil {
+		t.Fatalf("expected the refreshed token to be accepted, got %v", err)
+	}
+	refreshed, _ := config.TokenStore.Load()
+	if refreshed.AccessToken == tok.AccessToken {
+		t.Error("expected the refreshed access token to be saved")
+	}
+	if refreshed.RefreshToken == tok.RefreshToken {
+		t.Error("expected the rotated refresh token to be saved")
+	}
+	if !refreshed.Expiry.After(time.Now()) {
+		t.Errorf("expected the refreshed token to expire later, it expires %v", refreshed.Expiry)
+	}
+}
@@ -0,0 +1,632 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zmb3/spotify"
+)
+
+// how long each kind of cached result is considered fresh, stale results are still used but refreshed in the background
+const (
+	savedTracksTTL     = time.Hour
+	playlistsTTL       = 10 * time.Minute
+	playlistTracksTTL  = 10 * time.Minute // only used when the playlist's snapshot_id is unknown
+	followedArtistsTTL = time.Hour
+	artistAlbumsTTL    = 7 * 24 * time.Hour
+	albumTracksTTL     = 30 * 24 * time.Hour
+	relatedArtistsTTL  = 7 * 24 * time.Hour
+	popularTracksTTL   = 24 * time.Hour
+)
+
+const savedTracksKey = "saved-tracks"
+
+// playlistKey is where a playlist's items are cached, in playlist order
+func playlistKey(id string) string {
+	// "playlist-" entries were sorted by artist, which loses the positions
+	return "playlist-items-" + id
+}
+
+// cacheEntry is the on-disk form of a cached result
+type cacheEntry struct {
+	Saved time.Time `json:"saved"`
+	// Version must match for the entry to be used at all, e.g. a playlist's snapshot_id
+	Version string          `json:"version,omitempty"`
+	Data    json.RawMessage `json:"data"`
+}
+
+// cachedLibrary is a MusicLibrary that keeps the results of another one on disk
+type cachedLibrary struct {
+	library MusicLibrary
+	dir     string
+	// market is part of the version of results that depend on it, so changing it refetches them
+	market string
+	// refresh ignores anything already cached, results are still written
+	refresh bool
+	// offline only uses what is cached and journals changes instead of making them
+	offline bool
+	journal *journal
+	notify  func(message string)
+
+	mu        sync.Mutex
+	snapshots map[string]string // playlist ID -> snapshot_id from the last playlist listing
+	inflight  map[string]bool   // keys being refreshed in the background
+}
+
+func newCachedLibrary(library MusicLibrary, dir string, market string, refresh bool, notify func(message string)) (*cachedLibrary, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create cache dir: %v", err)
+	}
+	return &cachedLibrary{
+		library:   library,
+		dir:       dir,
+		market:    market,
+		refresh:   refresh,
+		journal:   &journal{path: filepath.Join(dir, "pending.jsonl")},
+		notify:    notify,
+		snapshots: map[string]string{},
+		inflight:  map[string]bool{},
+	}, nil
+}
+
+// newOfflineLibrary browses the last cached snapshot in dir without any network access
+func newOfflineLibrary(dir string, notify func(message string)) (*cachedLibrary, error) {
+	c, err := newCachedLibrary(nil, dir, "", false, notify)
+	if err != nil {
+		return nil, err
+	}
+	c.offline = true
+	return c, nil
+}
+
+// defaultCacheDir is spotui's directory under XDG_CACHE_HOME (or the platform equivalent)
+func defaultCacheDir() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "spotui"), nil
+}
+
+func (c *cachedLibrary) removeTrackFromPlaylist(ctx context.Context, id string, track string) error {
+	if c.offline {
+		err := c.journal.append(pendingOp{Op: "remove", Playlist: id, Track: track, At: time.Now()})
+		if err != nil {
+			return err
+		}
+		// keep the snapshot consistent with what's been done to it
+		return c.cacheRemoved(id, []string{track})
+	}
+	err := c.library.removeTrackFromPlaylist(ctx, id, track)
+	c.invalidate(id, err, func() error {
+		return c.cacheRemoved(id, []string{track})
+	})
+	return err
+}
+
+func (c *cachedLibrary) removeTracksFromPlaylistAt(ctx context.Context, id string, snapshot string, tracks []spotify.TrackToRemove) (string, error) {
+	if c.offline {
+		positions := map[int]string{} // position -> URI of the item there
+		for _, track := range tracks {
+			err := c.journal.append(pendingOp{Op: "remove", Playlist: id, URI: track.URI, Positions: track.Positions, Snapshot: snapshot, At: time.Now()})
+			if err != nil {
+				return "", err
+			}
+			for _, position := range track.Positions {
+				positions[position] = track.URI
+			}
+		}
+		// there's no new snapshot_id until the journal is replayed, the positions are relative to the cached playlist
+		return "", removeCached(c, playlistKey(id), func(i int, item spotify.PlaylistTrack) bool {
+			return positions[i] != "" && positions[i] == string(item.Track.URI)
+		})
+	}
+	snapshot, err := c.library.removeTracksFromPlaylistAt(ctx, id, snapshot, tracks)
+	c.invalidate(id, err, nil)
+	return snapshot, err
+}
+
+func (c *cachedLibrary) addTrackToPlaylist(ctx context.Context, id string, track string) error {
+	if c.offline {
+		err := c.journal.append(pendingOp{Op: "add", Playlist: id, Track: track, At: time.Now()})
+		if err != nil {
+			return err
+		}
+		// keep the snapshot consistent with what's been done to it, like removeTrackFromPlaylist
+		_, err = c.cacheAdded(id, []string{track})
+		return err
+	}
+	err := c.library.addTrackToPlaylist(ctx, id, track)
+	c.invalidate(id, err, func() error {
+		return c.cacheLiked([]string{track})
+	})
+	return err
+}
+
+// addTracksToPlaylist journals each track offline, like addTrackToPlaylist
+func (c *cachedLibrary) addTracksToPlaylist(ctx context.Context, id string, tracks []string) error {
+	if c.offline {
+		for _, track := range tracks {
+			if err := c.addTrackToPlaylist(ctx, id, track); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	err := c.library.addTracksToPlaylist(ctx, id, tracks)
+	c.invalidate(id, err, func() error {
+		return c.cacheLiked(tracks)
+	})
+	return err
+}
+
+// removeTracksFromPlaylist journals each track offline, like removeTrackFromPlaylist
+func (c *cachedLibrary) removeTracksFromPlaylist(ctx context.Context, id string, tracks []string) error {
+	if c.offline {
+		for _, track := range tracks {
+			if err := c.removeTrackFromPlaylist(ctx, id, track); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	err := c.library.removeTracksFromPlaylist(ctx, id, tracks)
+	c.invalidate(id, err, func() error {
+		return c.cacheRemoved(id, tracks)
+	})
+	return err
+}
+
+// errPlaylistOffline is returned for changes to the playlists themselves offline, only added and removed tracks are
+// journaled
+var errPlaylistOffline = errors.New("playlists can't be created, changed, deleted or reordered offline")
+
+func (c *cachedLibrary) reorderPlaylistTracks(ctx context.Context, id string, snapshot string, start int, length int, insertBefore int) (string, error) {
+	if c.offline {
+		return "", errPlaylistOffline
+	}
+	snapshot, err := c.library.reorderPlaylistTracks(ctx, id, snapshot, start, length, insertBefore)
+	c.invalidate(id, err, nil)
+	return snapshot, err
+}
+
+func (c *cachedLibrary) createPlaylist(ctx context.Context, details playlistDetails) (spotify.SimplePlaylist, error) {
+	if c.offline {
+		return spotify.SimplePlaylist{}, errPlaylistOffline
+	}
+	playlist, err := c.library.createPlaylist(ctx, details)
+	// listed again rather than shown as they were on the next launch
+	c.drop("playlists")
+	return playlist, err
+}
+
+func (c *cachedLibrary) changePlaylist(ctx context.Context, id string, details playlistDetails) error {
+	if c.offline {
+		return errPlaylistOffline
+	}
+	err := c.library.changePlaylist(ctx, id, details)
+	c.drop("playlists")
+	return err
+}
+
+func (c *cachedLibrary) deletePlaylist(ctx context.Context, id string) error {
+	if c.offline {
+		return errPlaylistOffline
+	}
+	err := c.library.deletePlaylist(ctx, id)
+	c.invalidate(id, err, nil)
+	c.drop("playlists")
+	return err
+}
+
+// getPlaylistDescription isn't cached, it's only fetched to change the playlist, which needs a connection anyway
+func (c *cachedLibrary) getPlaylistDescription(ctx context.Context, id string) (string, error) {
+	if c.offline {
+		return "", errPlaylistOffline
+	}
+	return c.library.getPlaylistDescription(ctx, id)
+}
+
+func (c *cachedLibrary) getAllSavedTracks(ctx context.Context, progress func(fetched int, total int)) ([]spotify.SavedTrack, error) {
+	all, err := cachedOr(ctx, c, savedTracksKey, savedTracksTTL, c.market, func(ctx context.Context) ([]spotify.SavedTrack, error) {
+		return c.library.getAllSavedTracks(ctx, progress)
+	}, func(ctx context.Context) ([]spotify.SavedTrack, error) {
+		return c.library.getAllSavedTracks(ctx, nil)
+	})
+	if err == nil && progress != nil {
+		progress(len(all), len(all))
+	}
+	return all, err
+}
+
+func (c *cachedLibrary) getAllPlaylistsForUser(ctx context.Context) ([]spotify.SimplePlaylist, error) {
+	all, err := cached(ctx, c, "playlists", playlistsTTL, "", func(ctx context.Context) ([]spotify.SimplePlaylist, error) {
+		all, err := c.library.getAllPlaylistsForUser(ctx)
+		if err == nil {
+			c.rememberSnapshots(all)
+		}
+		return all, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	c.rememberSnapshots(all)
+	return all, nil
+}
+
+func (c *cachedLibrary) rememberSnapshots(playlists []spotify.SimplePlaylist) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, item := range playlists {
+		c.snapshots[item.ID.String()] = item.SnapshotID
+	}
+}
+
+// getAllSongsByPlaylist only passes pages on when it has to list the playlist, a cached one is returned whole
+func (c *cachedLibrary) getAllSongsByPlaylist(ctx context.Context, id string, page func(items []spotify.PlaylistTrack)) ([]spotify.PlaylistTrack, error) {
+	c.mu.Lock()
+	snapshot := c.snapshots[id]
+	c.mu.Unlock()
+	ttl := playlistTracksTTL
+	if snapshot != "" {
+		// the snapshot_id changes whenever the playlist does
+		ttl = 0
+	}
+	return cachedOr(ctx, c, playlistKey(id), ttl, snapshot+"/"+c.market, func(ctx context.Context) ([]spotify.PlaylistTrack, error) {
+		return c.library.getAllSongsByPlaylist(ctx, id, page)
+	}, func(ctx context.Context) ([]spotify.PlaylistTrack, error) {
+		return c.library.getAllSongsByPlaylist(ctx, id, nil)
+	})
+}
+
+func (c *cachedLibrary) getAllSongsByAlbum(ctx context.Context, id string) ([]spotify.SimpleTrack, error) {
+	return cached(ctx, c, "album-"+id, albumTracksTTL, "", func(ctx context.Context) ([]spotify.SimpleTrack, error) {
+		return c.library.getAllSongsByAlbum(ctx, id)
+	})
+}
+
+func (c *cachedLibrary) getAllAlbumsByArtist(ctx context.Context, id string) ([]spotify.SimpleAlbum, error) {
+	return cached(ctx, c, "artist-albums-"+id, artistAlbumsTTL, c.market, func(ctx context.Context) ([]spotify.SimpleAlbum, error) {
+		return c.library.getAllAlbumsByArtist(ctx, id)
+	})
+}
+
+func (c *cachedLibrary) getRelatedArtists(ctx context.Context, id string) ([]spotify.FullArtist, error) {
+	return cached(ctx, c, "related-artists-"+id, relatedArtistsTTL, "", func(ctx context.Context) ([]spotify.FullArtist, error) {
+		return c.library.getRelatedArtists(ctx, id)
+	})
+}
+
+func (c *cachedLibrary) getAllFollowedArtists(ctx context.Context) ([]spotify.FullArtist, error) {
+	return cached(ctx, c, "followed-artists", followedArtistsTTL, "", func(ctx context.Context) ([]spotify.FullArtist, error) {
+		return c.library.getAllFollowedArtists(ctx)
+	})
+}
+
+func (c *cachedLibrary) getPopularTracks(ctx context.Context, id string) ([]spotify.FullTrack, error) {
+	return cached(ctx, c, "popular-tracks-"+id, popularTracksTTL, c.market, func(ctx context.Context) ([]spotify.FullTrack, error) {
+		return c.library.getPopularTracks(ctx, id)
+	})
+}
+
+// invalidate drops what a change to the playlist made out of date, "" being the liked tracks. Those are too big to
+// throw away, so update, if set, makes a change that went through to the cached ones instead; otherwise they're
+// used until the background refresh replaces them.
+func (c *cachedLibrary) invalidate(id string, err error, update func() error) {
+	if id == "" {
+		if err != nil || update == nil || update() != nil {
+			c.expire(savedTracksKey)
+		}
+		return
+	}
+	c.mu.Lock()
+	delete(c.snapshots, id)
+	c.mu.Unlock()
+	c.drop(playlistKey(id))
+	c.expire("playlists")
+}
+
+// drop removes an entry so it's fetched again the next time it's used
+func (c *cachedLibrary) drop(key string) {
+	os.Remove(c.path(key))
+}
+
+// expire marks an entry as stale so it is refreshed the next time it's used
+func (c *cachedLibrary) expire(key string) {
+	entry, err := c.read(key)
+	if err != nil {
+		return
+	}
+	entry.Saved = time.Time{}
+	c.write(key, entry)
+}
+
+// cached returns the entry for key if it is cached with a matching version, refreshing it in the background
+// once it's older than ttl (0 never expires), otherwise it fetches, stores and returns a new result
+func cached[T any](ctx context.Context, c *cachedLibrary, key string, ttl time.Duration, version string, fetch func(ctx context.Context) (T, error)) (T, error) {
+	return cachedOr(ctx, c, key, ttl, version, fetch, fetch)
+}
+
+// cachedOr is cached with its own fetch for refreshing in the background, one that doesn't report to the caller,
+// which has already returned
+func cachedOr[T any](ctx context.Context, c *cachedLibrary, key string, ttl time.Duration, version string, fetch func(ctx context.Context) (T, error), refresh func(ctx context.Context) (T, error)) (T, error) {
+	var result T
+	if c.offline {
+		entry, err := c.read(key)
+		if err != nil {
+			return result, fmt.Errorf("%s is not available offline", key)
+		}
+		err = json.Unmarshal(entry.Data, &result)
+		return result, err
+	}
+	if !c.refresh {
+		entry, err := c.read(key)
+		if err == nil && entry.Version == version && json.Unmarshal(entry.Data, &result) == nil {
+			if ttl > 0 && time.Since(entry.Saved) > ttl {
+				c.refreshInBackground(key, func() error {
+					// not tied to ctx, the caller has what it needs
+					_, err := store(context.Background(), c, key, version, refresh)
+					return err
+				})
+			}
+			return result, nil
+		}
+	}
+	return store(ctx, c, key, version, fetch)
+}
+
+// removeCached drops the items matching remove, given their index, from a cached list, keeping the entry's age and version
+func removeCached[T any](c *cachedLibrary, key string, remove func(i int, item T) bool) error {
+	entry, err := c.read(key)
+	if err != nil {
+		return nil
+	}
+	items := []T{}
+	err = json.Unmarshal(entry.Data, &items)
+	if err != nil {
+		return err
+	}
+	kept := []T{}
+	for i, item := range items {
+		if !remove(i, item) {
+			kept = append(kept, item)
+		}
+	}
+	entry.Data, err = json.Marshal(kept)
+	if err != nil {
+		return err
+	}
+	return c.write(key, entry)
+}
+
+// appendCached adds to a cached list with add, keeping the entry's age and version
+func appendCached[T any](c *cachedLibrary, key string, add func(items []T) []T) error {
+	entry, err := c.read(key)
+	if err != nil {
+		return nil
+	}
+	items := []T{}
+	err = json.Unmarshal(entry.Data, &items)
+	if err != nil {
+		return err
+	}
+	entry.Data, err = json.Marshal(add(items))
+	if err != nil {
+		return err
+	}
+	return c.write(key, entry)
+}
+
+// cacheAdded lists tracks added to a playlist, or to the liked tracks when id is "", in the cached entry. It tells
+// whether they were all found in the cache, any that weren't are only known by their ID.
+func (c *cachedLibrary) cacheAdded(id string, tracks []string) (bool, error) {
+	found := true
+	full := []spotify.FullTrack{}
+	for _, track := range tracks {
+		item, ok := c.findCachedTrack(spotify.ID(track))
+		found = found && ok
+		full = append(full, item)
+	}
+	addedAt := time.Now().UTC().Format(spotify.TimestampLayout)
+	if id == "" {
+		return found, appendCached(c, savedTracksKey, func(items []spotify.SavedTrack) []spotify.SavedTrack {
+			saved := map[spotify.ID]bool{}
+			for _, item := range items {
+				saved[item.ID] = true
+			}
+			for _, track := range full {
+				if !saved[track.ID] {
+					saved[track.ID] = true
+					items = append(items, spotify.SavedTrack{AddedAt: addedAt, FullTrack: track})
+				}
+			}
+			sort.Sort(bySavedTrack(items))
+			return items
+		})
+	}
+	return found, appendCached(c, playlistKey(id), func(items []spotify.PlaylistTrack) []spotify.PlaylistTrack {
+		for _, track := range full {
+			items = append(items, spotify.PlaylistTrack{AddedAt: addedAt, Track: track})
+		}
+		return items
+	})
+}
+
+// cacheLiked lists tracks liked online in the cached liked tracks. One that isn't cached anywhere else can't be
+// shown until it's fetched, so that fails and the liked tracks are refreshed instead.
+func (c *cachedLibrary) cacheLiked(tracks []string) error {
+	found, err := c.cacheAdded("", tracks)
+	if err == nil && !found {
+		err = errors.New("liked tracks that aren't cached")
+	}
+	return err
+}
+
+// cacheRemoved drops every copy of the tracks from a playlist's cached entry, or the liked tracks when id is ""
+func (c *cachedLibrary) cacheRemoved(id string, tracks []string) error {
+	removed := map[string]bool{}
+	for _, track := range tracks {
+		removed[track] = true
+	}
+	if id == "" {
+		return removeCached(c, savedTracksKey, func(i int, item spotify.SavedTrack) bool { return removed[item.ID.String()] })
+	}
+	return removeCached(c, playlistKey(id), func(i int, item spotify.PlaylistTrack) bool { return removed[item.Track.ID.String()] })
+}
+
+// findCachedTrack looks a track up in the cached liked tracks, playlists, albums and top tracks, telling whether it
+// was found. A track that isn't there is only known by its ID.
+func (c *cachedLibrary) findCachedTrack(id spotify.ID) (spotify.FullTrack, bool) {
+	saved := []spotify.SavedTrack{}
+	if c.readCached(savedTracksKey, &saved) {
+		for _, item := range saved {
+			if item.ID == id {
+				return item.FullTrack, true
+			}
+		}
+	}
+	for _, key := range c.cachedKeys(playlistKey("*")) {
+		items := []spotify.PlaylistTrack{}
+		if c.readCached(key, &items) {
+			for _, item := range items {
+				if item.Track.ID == id {
+					return item.Track, true
+				}
+			}
+		}
+	}
+	for _, key := range c.cachedKeys("popular-tracks-*") {
+		items := []spotify.FullTrack{}
+		if c.readCached(key, &items) {
+			for _, item := range items {
+				if item.ID == id {
+					return item, true
+				}
+			}
+		}
+	}
+	for _, key := range c.cachedKeys("album-*") {
+		items := []spotify.SimpleTrack{}
+		if c.readCached(key, &items) {
+			for _, item := range items {
+				if item.ID == id {
+					return spotify.FullTrack{SimpleTrack: item}, true
+				}
+			}
+		}
+	}
+	return spotify.FullTrack{SimpleTrack: spotify.SimpleTrack{ID: id, URI: spotify.URI("spotify:track:" + id)}}, false
+}
+
+// cachedKeys are the keys of the cached entries matching pattern
+func (c *cachedLibrary) cachedKeys(pattern string) []string {
+	paths, _ := filepath.Glob(c.path(pattern))
+	keys := []string{}
+	for _, path := range paths {
+		keys = append(keys, strings.TrimSuffix(filepath.Base(path), ".json"))
+	}
+	return keys
+}
+
+// readCached decodes the cached entry for key into v, telling whether it could
+func (c *cachedLibrary) readCached(key string, v interface{}) bool {
+	entry, err := c.read(key)
+	return err == nil && json.Unmarshal(entry.Data, v) == nil
+}
+
+func store[T any](ctx context.Context, c *cachedLibrary, key string, version string, fetch func(ctx context.Context) (T, error)) (T, error) {
+	result, err := fetch(ctx)
+	if err != nil {
+		return result, err
+	}
+	data, err := json.Marshal(result)
+	if err == nil {
+		err = c.write(key, &cacheEntry{Saved: time.Now(), Version: version, Data: data})
+	}
+	if err != nil {
+		c.report(fmt.Sprintf("unable to cache %s: %v", key, err))
+	}
+	return result, nil
+}
+
+func (c *cachedLibrary) refreshInBackground(key string, refresh func() error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.inflight[key] {
+		return
+	}
+	c.inflight[key] = true
+	go func() {
+		err := refresh()
+		c.mu.Lock()
+		delete(c.inflight, key)
+		c.mu.Unlock()
+		if err != nil {
+			c.report(fmt.Sprintf("unable to refresh %s: %v", key, err))
+		}
+	}()
+}
+
+func (c *cachedLibrary) path(key string) string {
+	return filepath.Join(c.dir, key+".json")
+}
+
+func (c *cachedLibrary) read(key string) (*cacheEntry, error) {
+	b, err := ioutil.ReadFile(c.path(key))
+	if err != nil {
+		return nil, err
+	}
+	entry := &cacheEntry{}
+	err = json.Unmarshal(b, entry)
+	if err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+func (c *cachedLibrary) write(key string, entry *cacheEntry) error {
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(c.path(key), b, 0600)
+}
+
+func (c *cachedLibrary) report(message string) {
+	if c.notify != nil {
+		c.notify(message)
+	}
+}
+
+// writeFileAtomic writes to a temp file in the same directory and renames it over path,
+// so readers never see a partial file
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Chmod(perm)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/zmb3/spotify"
+)
+
+// newFixtureCache is a cachedLibrary over the fixture library, caching in a new directory
+func newFixtureCache(t *testing.T) (*FakeLibrary, *cachedLibrary) {
+	t.Helper()
+	fake, err := NewFakeLibraryFromFile("fixtures/library.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := newCachedLibrary(fake, t.TempDir(), "", false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fake, c
+}
+
+func savedIDs(items []spotify.SavedTrack) map[string]bool {
+	ids := map[string]bool{}
+	for _, item := range items {
+		ids[item.ID.String()] = true
+	}
+	return ids
+}
+
+func TestOnlineChangesShowOnTheNextLaunch(t *testing.T) {
+	ctx := context.Background()
+	fake, c := newFixtureCache(t)
+	if _, err := c.getAllSavedTracks(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.getAllPlaylistsForUser(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// so the track liked below is cached
+	if _, err := c.getAllSongsByPlaylist(ctx, "fakeplaylist001", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	created, err := c.createPlaylist(ctx, playlistDetails{Name: "New", Access: accessPrivate})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.deletePlaylist(ctx, "fakeplaylist003"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.addTrackToPlaylist(ctx, "", "faketrack00002"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.removeTracksFromPlaylist(ctx, "", []string{"faketrack00028"}); err != nil {
+		t.Fatal(err)
+	}
+
+	next, err := newCachedLibrary(fake, c.dir, "", false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	playlists, err := next.getAllPlaylistsForUser(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listed := map[spotify.ID]bool{}
+	for _, item := range playlists {
+		listed[item.ID] = true
+	}
+	if !listed[created.ID] || listed["fakeplaylist003"] {
+		t.Errorf("expected the new playlist and not the deleted one, got %v", listed)
+	}
+	// the liked tracks are used as cached, they're changed in place
+	saved := []spotify.SavedTrack{}
+	if !next.readCached(savedTracksKey, &saved) {
+		t.Fatal("expected the liked tracks to stay cached")
+	}
+	ids := savedIDs(saved)
+	if !ids["faketrack00002"] || ids["faketrack00028"] {
+		t.Errorf("expected the liked and unliked tracks in the cache, got %v", ids)
+	}
+	for _, item := range saved {
+		if item.ID == "faketrack00002" && item.Name == "" {
+			t.Errorf("expected the liked track to be cached in full, got %+v", item)
+		}
+	}
+}
+
+func TestLikingAnUncachedTrackRefreshesTheLikedTracks(t *testing.T) {
+	ctx := context.Background()
+	_, c := newFixtureCache(t)
+	if _, err := c.getAllSavedTracks(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.addTrackToPlaylist(ctx, "", "faketrack00003"); err != nil {
+		t.Fatal(err)
+	}
+	entry, err := c.read(savedTracksKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !entry.Saved.IsZero() {
+		t.Errorf("expected the liked tracks to be refreshed the next time they're used")
+	}
+}
+
+func TestOfflineChangesAreJournaledAndCached(t *testing.T) {
+	ctx := context.Background()
+	_, online := newFixtureCache(t)
+	if _, err := online.getAllSavedTracks(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := online.getAllSongsByPlaylist(ctx, "fakeplaylist001", nil); err != nil {
+		t.Fatal(err)
+	}
+	c, err := newOfflineLibrary(online.dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.addTrackToPlaylist(ctx, "", "faketrack00015"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.removeTrackFromPlaylist(ctx, "", "faketrack00028"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.addTrackToPlaylist(ctx, "fakeplaylist001", "faketrack00001"); err != nil {
+		t.Fatal(err)
+	}
+	// only the second copy of the track
+	_, err = c.removeTracksFromPlaylistAt(ctx, "fakeplaylist001", "snap-001-1",
+		[]spotify.TrackToRemove{{URI: "spotify:track:faketrack00002", Positions: []int{4}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ops, err := c.journal.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ops) != 4 {
+		t.Errorf("expected 4 journaled changes, got %v", ops)
+	}
+	saved, err := c.getAllSavedTracks(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := savedIDs(saved)
+	if !ids["faketrack00015"] || ids["faketrack00028"] {
+		t.Errorf("expected the liked and unliked tracks in the cache, got %v", ids)
+	}
+	items, err := c.getAllSongsByPlaylist(ctx, "fakeplaylist001", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []string{}
+	for _, item := range items {
+		got = append(got, item.Track.ID.String())
+	}
+	want := []string{"faketrack00002", "faketrack00015", "faketrack00021", "faketrack00028", "faketrack00001"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("expected %v cached, got %v", want, got)
+	}
+	if items[len(items)-1].Track.Name == "" {
+		t.Errorf("expected the added track to be cached in full, got %+v", items[len(items)-1].Track)
+	}
+}
@@ -1,12 +1,43 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
 	"sort"
 	"strings"
 
 	"github.com/zmb3/spotify"
 )
 
+// pageLimit is the largest page size the Web API allows for the paged endpoints used here
+const pageLimit = 50
+
+// pageWorkers is the number of pages fetched at once for large listings
+const pageWorkers = 4
+
+// playlistBatchSize and libraryBatchSize are the most tracks the Web API changes in one request, in a playlist and in
+// the liked tracks
+const (
+	playlistBatchSize = 100
+	libraryBatchSize  = 50
+)
+
+// batches splits items into slices of at most size items
+func batches[T any](items []T, size int) [][]T {
+	result := [][]T{}
+	for len(items) > size {
+		result = append(result, items[:size])
+		items = items[size:]
+	}
+	if len(items) > 0 {
+		result = append(result, items)
+	}
+	return result
+}
+
 // byArtistName assists in sorting artists by name
 type byArtistName []spotify.FullArtist
 
@@ -25,35 +56,198 @@ func (a byAlbumYear) Less(i, j int) bool {
 	return a[i].ReleaseDateTime().Before(a[j].ReleaseDateTime())
 }
 
-// byPlaylistTrack assists in sorting tracks by artist / name
-type byPlaylistTrack []spotify.PlaylistTrack
+// playlistItem is a playlist item and its 0-based position in the playlist
+type playlistItem struct {
+	spotify.PlaylistTrack
+	Position int
+}
+
+// byPlaylistTrack assists in sorting playlist items by artist / name
+type byPlaylistTrack []playlistItem
 
 func (a byPlaylistTrack) Len() int      { return len(a) }
 func (a byPlaylistTrack) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
 func (a byPlaylistTrack) Less(i, j int) bool {
-	return strings.TrimPrefix(a[i].Track.Artists[0].Name, "The ")+a[i].Track.Name < strings.TrimPrefix(a[j].Track.Artists[0].Name, "The ")+a[j].Track.Name
+	return sortKey(a[i].Track.Artists, a[i].Track.Name) < sortKey(a[j].Track.Artists, a[j].Track.Name)
 }
 
-// byPlaylistTrack assists in sorting tracks by artist / name
+// bySavedTrack assists in sorting tracks by artist / name
 type bySavedTrack []spotify.SavedTrack
 
 func (a bySavedTrack) Len() int      { return len(a) }
 func (a bySavedTrack) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
 func (a bySavedTrack) Less(i, j int) bool {
-	return strings.TrimPrefix(a[i].Artists[0].Name, "The ")+a[i].Name < strings.TrimPrefix(a[j].Artists[0].Name, "The ")+a[j].Name
+	return sortKey(a[i].Artists, a[i].Name) < sortKey(a[j].Artists, a[j].Name)
+}
+
+// sortKey orders tracks by artist and name, local files and episodes may have no artists
+func sortKey(artists []spotify.SimpleArtist, name string) string {
+	return strings.TrimPrefix(artistName(artists), "The ") + name
+}
+
+// artistName is the name of the first artist, "" when there isn't one
+func artistName(artists []spotify.SimpleArtist) string {
+	if len(artists) == 0 {
+		return ""
+	}
+	return artists[0].Name
+}
+
+// reorder moves the length items from start to before the item at insertBefore, like Spotify's reorder endpoint,
+// returning a new slice
+func reorder[T any](items []T, start int, length int, insertBefore int) []T {
+	if insertBefore >= start && insertBefore <= start+length {
+		// into the range itself, nothing moves
+		return append([]T{}, items...)
+	}
+	moved := append([]T{}, items[start:start+length]...)
+	rest := append(append([]T{}, items[:start]...), items[start+length:]...)
+	if insertBefore > start {
+		insertBefore -= length
+	}
+	return append(append(append([]T{}, rest[:insertBefore]...), moved...), rest[insertBefore:]...)
+}
+
+// playlistItemKind is what a playlist item is, only catalog tracks can be looked up, liked or added by ID
+type playlistItemKind int
+
+const (
+	// catalogTrack is a track on Spotify
+	catalogTrack playlistItemKind = iota
+	// localTrack is a file on the user's computer, it has a spotify:local: URI but no ID
+	localTrack
+	// podcastEpisode is an episode of a show, its ID is an episode ID
+	podcastEpisode
+	// removedTrack has been taken off Spotify, it comes back with no ID or data
+	removedTrack
+)
+
+// itemKind tells what kind of item a playlist item is
+func itemKind(item spotify.PlaylistTrack) playlistItemKind {
+	switch {
+	case item.IsLocal || strings.HasPrefix(string(item.Track.URI), "spotify:local:"):
+		return localTrack
+	case item.Track.Type == "episode" || strings.HasPrefix(string(item.Track.URI), "spotify:episode:"):
+		return podcastEpisode
+	case item.Track.ID == "":
+		return removedTrack
+	}
+	return catalogTrack
+}
+
+// playlist access levels, collaborative playlists are private but their followers can change them
+const (
+	accessPrivate       = "private"
+	accessPublic        = "public"
+	accessCollaborative = "collaborative"
+)
+
+// playlistDetails are what's set when creating or changing a playlist
+type playlistDetails struct {
+	Name        string
+	Description string
+	Access      string
+}
+
+// detailsOf is a playlist's details, SimplePlaylist has no description
+func detailsOf(item spotify.SimplePlaylist) playlistDetails {
+	access := accessPrivate
+	switch {
+	case item.Collaborative:
+		access = accessCollaborative
+	case item.IsPublic:
+		access = accessPublic
+	}
+	return playlistDetails{Name: item.Name, Access: access}
 }
 
-// Client wraps the github.com/zmb3/spotify with higher level utility funcs
+// MusicLibrary is the set of Spotify operations used by the UI
+type MusicLibrary interface {
+	removeTrackFromPlaylist(ctx context.Context, id string, track string) error
+	// removeTracksFromPlaylistAt removes the items at the given positions as of snapshot ("" for the current
+	// version), so one of several copies of a track can be removed. It returns the playlist's new snapshot_id.
+	removeTracksFromPlaylistAt(ctx context.Context, id string, snapshot string, tracks []spotify.TrackToRemove) (string, error)
+	addTrackToPlaylist(ctx context.Context, id string, track string) error
+	// addTracksToPlaylist and removeTracksFromPlaylist change many tracks at once, "" being the liked tracks
+	addTracksToPlaylist(ctx context.Context, id string, tracks []string) error
+	removeTracksFromPlaylist(ctx context.Context, id string, tracks []string) error
+	// reorderPlaylistTracks moves the length items from start to before the item at insertBefore, as of snapshot
+	// ("" for the current version). It returns the playlist's new snapshot_id.
+	reorderPlaylistTracks(ctx context.Context, id string, snapshot string, start int, length int, insertBefore int) (string, error)
+	createPlaylist(ctx context.Context, details playlistDetails) (spotify.SimplePlaylist, error)
+	// changePlaylist renames a playlist and sets its access and description, an empty description clears it
+	changePlaylist(ctx context.Context, id string, details playlistDetails) error
+	// getPlaylistDescription is a playlist's current description, playlist listings don't have it
+	getPlaylistDescription(ctx context.Context, id string) (string, error)
+	// deletePlaylist unfollows a playlist, which is how Spotify deletes the user's own playlists
+	deletePlaylist(ctx context.Context, id string) error
+	getAllSavedTracks(ctx context.Context, progress func(fetched int, total int)) ([]spotify.SavedTrack, error)
+	getAllPlaylistsForUser(ctx context.Context) ([]spotify.SimplePlaylist, error)
+	// getAllSongsByPlaylist passes each page of items to page, if it's not nil, as it arrives, before it returns
+	// them all
+	getAllSongsByPlaylist(ctx context.Context, id string, page func(items []spotify.PlaylistTrack)) ([]spotify.PlaylistTrack, error)
+	getAllSongsByAlbum(ctx context.Context, id string) ([]spotify.SimpleTrack, error)
+	getAllAlbumsByArtist(ctx context.Context, id string) ([]spotify.SimpleAlbum, error)
+	getRelatedArtists(ctx context.Context, id string) ([]spotify.FullArtist, error)
+	getAllFollowedArtists(ctx context.Context) ([]spotify.FullArtist, error)
+	getPopularTracks(ctx context.Context, id string) ([]spotify.FullTrack, error)
+}
+
+// Client wraps the github.com/zmb3/spotify with higher level utility funcs. zmb3/spotify doesn't take a context, so
+// ctx only stops paging between pages and a request already sent isn't aborted.
 type Client struct {
 	spotifyClient *spotify.Client
+	// http is the authenticated client under spotifyClient, for requests zmb3/spotify can't make
+	http *http.Client
+	// market is the country code tracks and albums are looked up in
+	market string
+}
+
+// NewSpoqClient creates a SpoqClient using the provided spotify client and the authenticated client under it, looking
+// things up in market
+func NewSpoqClient(client *spotify.Client, httpClient *http.Client, market string) *Client {
+	return &Client{spotifyClient: client, http: httpClient, market: market}
+}
+
+// userMarket is the configured market if there is one, otherwise the country of the user's account
+func userMarket(client *spotify.Client, configured string) (string, error) {
+	if configured != "" {
+		return configured, nil
+	}
+	user, err := client.CurrentUser()
+	if err != nil {
+		return "", fmt.Errorf("unable to get the user's country: %v", err)
+	}
+	if user.Country == "" {
+		// the token lacks the user-read-private scope, let Spotify work it out
+		return spotify.MarketFromToken, nil
+	}
+	return user.Country, nil
+}
+
+// playable tells whether a track can be played in market, from is_playable when it was looked up in a market
+// or its available_markets when it wasn't. Tracks are assumed to be playable when neither is known.
+func playable(market string, isPlayable *bool, availableMarkets []string) bool {
+	if isPlayable != nil {
+		return *isPlayable
+	}
+	if market == "" || market == spotify.MarketFromToken || len(availableMarkets) == 0 {
+		return true
+	}
+	for _, m := range availableMarkets {
+		if m == market {
+			return true
+		}
+	}
+	return false
 }
 
-// NewSpoqClient creates a SpoqClient using the provided spotify client
-func NewSpoqClient(client *spotify.Client) *Client {
-	return &Client{spotifyClient: client}
+// options are the paging options for a request, in the user's market
+func (c *Client) options(offset int, limit int) *spotify.Options {
+	return &spotify.Options{Limit: &limit, Offset: &offset, Country: &c.market}
 }
 
-func (c *Client) removeTrackFromPlaylist(id string, track string) error {
+func (c *Client) removeTrackFromPlaylist(ctx context.Context, id string, track string) error {
 	if id == "" {
 		err := c.spotifyClient.RemoveTracksFromLibrary(spotify.ID(track))
 		return err
@@ -62,7 +256,74 @@ func (c *Client) removeTrackFromPlaylist(id string, track string) error {
 	return err
 }
 
-func (c *Client) addTrackToPlaylist(id string, track string) error {
+func (c *Client) removeTracksFromPlaylistAt(ctx context.Context, id string, snapshot string, tracks []spotify.TrackToRemove) (string, error) {
+	// from the last position first, so removing a batch doesn't move the items of the next one
+	sorted := append([]spotify.TrackToRemove{}, tracks...)
+	sort.SliceStable(sorted, func(i, j int) bool { return lastPosition(sorted[i]) > lastPosition(sorted[j]) })
+	for _, batch := range batches(sorted, playlistBatchSize) {
+		var err error
+		snapshot, err = c.spotifyClient.RemoveTracksFromPlaylistOpt(spotify.ID(id), batch, snapshot)
+		if err != nil {
+			return "", err
+		}
+	}
+	return snapshot, nil
+}
+
+// lastPosition is the last of the positions of an item to remove
+func lastPosition(track spotify.TrackToRemove) int {
+	last := -1
+	for _, position := range track.Positions {
+		if position > last {
+			last = position
+		}
+	}
+	return last
+}
+
+func (c *Client) addTracksToPlaylist(ctx context.Context, id string, tracks []string) error {
+	if id == "" {
+		for _, batch := range batches(toIDs(tracks), libraryBatchSize) {
+			if err := c.spotifyClient.AddTracksToLibrary(batch...); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, batch := range batches(toIDs(tracks), playlistBatchSize) {
+		if _, err := c.spotifyClient.AddTracksToPlaylist(spotify.ID(id), batch...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Client) removeTracksFromPlaylist(ctx context.Context, id string, tracks []string) error {
+	if id == "" {
+		for _, batch := range batches(toIDs(tracks), libraryBatchSize) {
+			if err := c.spotifyClient.RemoveTracksFromLibrary(batch...); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, batch := range batches(toIDs(tracks), playlistBatchSize) {
+		if _, err := c.spotifyClient.RemoveTracksFromPlaylist(spotify.ID(id), batch...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func toIDs(tracks []string) []spotify.ID {
+	ids := make([]spotify.ID, len(tracks))
+	for i, track := range tracks {
+		ids[i] = spotify.ID(track)
+	}
+	return ids
+}
+
+func (c *Client) addTrackToPlaylist(ctx context.Context, id string, track string) error {
 	if id == "" {
 		err := c.spotifyClient.AddTracksToLibrary(spotify.ID(track))
 		return err
@@ -71,136 +332,190 @@ func (c *Client) addTrackToPlaylist(id string, track string) error {
 	return err
 }
 
-func (c *Client) getAllSavedTracks() ([]spotify.SavedTrack, error) {
-	all := []spotify.SavedTrack{}
-	page := 1
-	limit := 50
-	for {
-		offset := (page - 1) * limit
-		items, err := c.spotifyClient.CurrentUsersTracksOpt(&spotify.Options{Limit: &limit, Offset: &offset})
+func (c *Client) reorderPlaylistTracks(ctx context.Context, id string, snapshot string, start int, length int, insertBefore int) (string, error) {
+	return c.spotifyClient.ReorderPlaylistTracks(spotify.ID(id), spotify.PlaylistReorderOptions{
+		RangeStart:   start,
+		RangeLength:  length,
+		InsertBefore: insertBefore,
+		SnapshotID:   snapshot,
+	})
+}
+
+func (c *Client) createPlaylist(ctx context.Context, details playlistDetails) (spotify.SimplePlaylist, error) {
+	user, err := c.spotifyClient.CurrentUser()
+	if err != nil {
+		return spotify.SimplePlaylist{}, err
+	}
+	var playlist *spotify.FullPlaylist
+	if details.Access == accessCollaborative {
+		playlist, err = c.spotifyClient.CreateCollaborativePlaylistForUser(user.ID, details.Name, details.Description)
+	} else {
+		playlist, err = c.spotifyClient.CreatePlaylistForUser(user.ID, details.Name, details.Description, details.Access == accessPublic)
+	}
+	if err != nil {
+		return spotify.SimplePlaylist{}, err
+	}
+	return playlist.SimplePlaylist, nil
+}
+
+// changePlaylist sends the request itself, zmb3/spotify leaves out an empty description so it couldn't be cleared
+func (c *Client) changePlaylist(ctx context.Context, id string, details playlistDetails) error {
+	body, err := json.Marshal(struct {
+		Name        string `json:"name"`
+		Public      bool   `json:"public"`
+		Description string `json:"description"`
+	}{details.Name, details.Access == accessPublic, details.Description})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, spotifyAPIURL+"playlists/"+id, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 300 {
+		return nil
+	}
+	// the same error zmb3/spotify returns, so rejected changes are told apart from network failures
+	var e struct {
+		Error spotify.Error `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&e); err != nil || e.Error.Message == "" {
+		return spotify.Error{Message: resp.Status, Status: resp.StatusCode}
+	}
+	return e.Error
+}
+
+func (c *Client) getPlaylistDescription(ctx context.Context, id string) (string, error) {
+	playlist, err := c.spotifyClient.GetPlaylistOpt(spotify.ID(id), "description")
+	if err != nil {
+		return "", err
+	}
+	return playlist.Description, nil
+}
+
+func (c *Client) deletePlaylist(ctx context.Context, id string) error {
+	user, err := c.spotifyClient.CurrentUser()
+	if err != nil {
+		return err
+	}
+	return c.spotifyClient.UnfollowPlaylist(spotify.ID(user.ID), spotify.ID(id))
+}
+
+func (c *Client) getAllSavedTracks(ctx context.Context, progress func(fetched int, total int)) ([]spotify.SavedTrack, error) {
+	all, err := newOffsetPaginator(pageLimit, func(offset int, limit int) ([]spotify.SavedTrack, int, bool, error) {
+		items, err := c.spotifyClient.CurrentUsersTracksOpt(c.options(offset, limit))
 		if err != nil {
-			return nil, err
+			return nil, 0, false, err
 		}
-		all = append(all, items.Tracks...)
-		if items.Next == "" {
-			break
-		}
-		page = page + 1
+		return items.Tracks, items.Total, items.Next != "", nil
+	}).Concurrently(pageWorkers).OnProgress(progress).All(ctx)
+	if err != nil {
+		return nil, err
 	}
 	sort.Sort(bySavedTrack(all))
 	return all, nil
 }
 
-func (c *Client) getAllPlaylistsForUser() ([]spotify.SimplePlaylist, error) {
+func (c *Client) getAllPlaylistsForUser(ctx context.Context) ([]spotify.SimplePlaylist, error) {
 	user, err := c.spotifyClient.CurrentUser()
 	if err != nil {
 		return nil, err
 	}
 	all := []spotify.SimplePlaylist{}
-	page := 1
-	limit := 50
-	for {
-		offset := (page - 1) * limit
+	err = newOffsetPaginator(pageLimit, func(offset int, limit int) ([]spotify.SimplePlaylist, int, bool, error) {
 		items, err := c.spotifyClient.CurrentUsersPlaylistsOpt(&spotify.Options{Limit: &limit, Offset: &offset})
 		if err != nil {
-			return nil, err
+			return nil, 0, false, err
 		}
-		for _, item := range items.Playlists {
+		return items.Playlists, items.Total, items.Next != "", nil
+	}).Each(ctx, func(items []spotify.SimplePlaylist) error {
+		for _, item := range items {
 			if item.Owner.ID == user.ID {
 				all = append(all, item)
 			}
 		}
-		if items.Next == "" {
-			break
-		}
-		page = page + 1
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 	return all, nil
 }
 
-func (c *Client) getAllSongsByPlaylist(id string) ([]spotify.PlaylistTrack, error) {
+// getAllSongsByPlaylist lists a playlist's items in playlist order, positional changes depend on it
+func (c *Client) getAllSongsByPlaylist(ctx context.Context, id string, page func(items []spotify.PlaylistTrack)) ([]spotify.PlaylistTrack, error) {
 	all := []spotify.PlaylistTrack{}
-	page := 1
-	limit := 50
-	for {
-		offset := (page - 1) * limit
-		items, err := c.spotifyClient.GetPlaylistTracksOpt(spotify.ID(id), &spotify.Options{Limit: &limit, Offset: &offset}, "")
+	err := newOffsetPaginator(pageLimit, func(offset int, limit int) ([]spotify.PlaylistTrack, int, bool, error) {
+		items, err := c.spotifyClient.GetPlaylistTracksOpt(spotify.ID(id), c.options(offset, limit), "")
 		if err != nil {
-			return nil, err
+			return nil, 0, false, err
 		}
-		all = append(all, items.Tracks...)
-		if items.Next == "" {
-			break
+		return items.Tracks, items.Total, items.Next != "", nil
+	}).Each(ctx, func(items []spotify.PlaylistTrack) error {
+		all = append(all, items...)
+		if page != nil {
+			page(items)
 		}
-		page = page + 1
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
-	sort.Sort(byPlaylistTrack(all))
 	return all, nil
 }
 
-func (c *Client) getAllSongsByAlbum(id string) ([]spotify.SimpleTrack, error) {
-	all := []spotify.SimpleTrack{}
-	page := 1
-	limit := 50
-	for {
-		offset := (page - 1) * limit
+func (c *Client) getAllSongsByAlbum(ctx context.Context, id string) ([]spotify.SimpleTrack, error) {
+	// no market: with one Spotify replaces available_markets with is_playable, which SimpleTrack doesn't decode
+	return newOffsetPaginator(pageLimit, func(offset int, limit int) ([]spotify.SimpleTrack, int, bool, error) {
 		items, err := c.spotifyClient.GetAlbumTracksOpt(spotify.ID(id), &spotify.Options{Limit: &limit, Offset: &offset})
 		if err != nil {
-			return nil, err
+			return nil, 0, false, err
 		}
-		all = append(all, items.Tracks...)
-		if items.Next == "" {
-			break
-		}
-		page = page + 1
-	}
-	return all, nil
+		return items.Tracks, items.Total, items.Next != "", nil
+	}).All(ctx)
 }
 
-func (c *Client) getAllAlbumsByArtist(id string) ([]spotify.SimpleAlbum, error) {
-	all := []spotify.SimpleAlbum{}
+func (c *Client) getAllAlbumsByArtist(ctx context.Context, id string) ([]spotify.SimpleAlbum, error) {
 	albumTypes := spotify.AlbumTypeAlbum | spotify.AlbumTypeSingle
-	page := 1
-	limit := 50
-	//country := spotify.CountryUSA
-	for {
-		offset := (page - 1) * limit
-		items, err := c.spotifyClient.GetArtistAlbumsOpt(spotify.ID(id), &spotify.Options{Limit: &limit, Offset: &offset}, albumTypes)
+	all, err := newOffsetPaginator(pageLimit, func(offset int, limit int) ([]spotify.SimpleAlbum, int, bool, error) {
+		items, err := c.spotifyClient.GetArtistAlbumsOpt(spotify.ID(id), c.options(offset, limit), albumTypes)
 		if err != nil {
-			return nil, err
-		}
-		all = append(all, items.Albums...)
-		if items.Next == "" {
-			break
+			return nil, 0, false, err
 		}
-		page = page + 1
+		return items.Albums, items.Total, items.Next != "", nil
+	}).All(ctx)
+	if err != nil {
+		return nil, err
 	}
 	sort.Sort(byAlbumYear(all))
 	return all, nil
 }
 
-func (c *Client) getRelatedArtists(id string) ([]spotify.FullArtist, error) {
+func (c *Client) getRelatedArtists(ctx context.Context, id string) ([]spotify.FullArtist, error) {
 	return c.spotifyClient.GetRelatedArtists(spotify.ID(id))
 }
 
-func (c *Client) getAllFollowedArtists() ([]spotify.FullArtist, error) {
-	all := []spotify.FullArtist{}
-	next := ""
-	for {
-		items, err := c.spotifyClient.CurrentUsersFollowedArtistsOpt(-1, next)
+func (c *Client) getAllFollowedArtists(ctx context.Context) ([]spotify.FullArtist, error) {
+	all, err := newCursorPaginator(func(after string) ([]spotify.FullArtist, string, int, error) {
+		items, err := c.spotifyClient.CurrentUsersFollowedArtistsOpt(pageLimit, after)
 		if err != nil {
-			return nil, err
-		}
-		all = append(all, items.Artists...)
-		next = items.Cursor.After
-		if next == "" {
-			break
+			return nil, "", 0, err
 		}
+		return items.Artists, items.Cursor.After, items.Total, nil
+	}).All(ctx)
+	if err != nil {
+		return nil, err
 	}
 	sort.Sort(byArtistName(all))
 	return all, nil
 }
 
-func (c *Client) getPopularTracks(id string) ([]spotify.FullTrack, error) {
-	return c.spotifyClient.GetArtistsTopTracks(spotify.ID(id), spotify.CountryUSA)
+func (c *Client) getPopularTracks(ctx context.Context, id string) ([]spotify.FullTrack, error) {
+	return c.spotifyClient.GetArtistsTopTracks(spotify.ID(id), c.market)
 }
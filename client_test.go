@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/zmb3/spotify"
+)
+
+// newStubClient is a Client logged in to the StubServer config points at
+func newStubClient(t *testing.T, config *SpotifyClientBuilderConfig) *Client {
+	t.Helper()
+	builder := NewSpotifyClientBuilder(config)
+	spotifyClient, err := builder.GetClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewSpoqClient(spotifyClient, builder.HTTPClient(), "US")
+}
+
+func TestPlaylistDescriptionCanBeChangedAndCleared(t *testing.T) {
+	ctx := context.Background()
+	_, config := newStubClientConfig(t)
+	client := newStubClient(t, config)
+	for _, description := range []string{"Songs for the drive", ""} {
+		err := client.changePlaylist(ctx, "fakeplaylist001", playlistDetails{Name: "Road Trip", Description: description, Access: accessPrivate})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := client.getPlaylistDescription(ctx, "fakeplaylist001")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != description {
+			t.Errorf("expected the description %q, got %q", description, got)
+		}
+	}
+	err := client.changePlaylist(ctx, "nosuchplaylist", playlistDetails{Name: "Gone", Access: accessPrivate})
+	if _, rejected := err.(spotify.Error); !rejected {
+		t.Errorf("expected Spotify's error for a missing playlist, got %v", err)
+	}
+}
+
+func TestLastPosition(t *testing.T) {
+	tests := []struct {
+		positions []int
+		want      int
+	}{
+		{nil, -1},
+		{[]int{0}, 0},
+		{[]int{7, 2, 5}, 7},
+		{[]int{3, 12}, 12},
+	}
+	for _, test := range tests {
+		if got := lastPosition(spotify.TrackToRemove{Positions: test.positions}); got != test.want {
+			t.Errorf("expected %d for %v, got %d", test.want, test.positions, got)
+		}
+	}
+}
+
+func TestRemoveTracksAtPositionsInBatches(t *testing.T) {
+	tests := []struct {
+		name   string
+		remove func(i int) bool
+	}{
+		{"every other item", func(i int) bool { return i%2 == 0 }},
+		{"the first 150 items", func(i int) bool { return i < 150 }},
+		{"every item", func(i int) bool { return true }},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stub, config := newStubClientConfig(t)
+			items := []spotify.PlaylistTrack{}
+			for i := 0; i < 250; i++ {
+				id := spotify.ID(fmt.Sprintf("track%03d", i))
+				items = append(items, spotify.PlaylistTrack{Track: spotify.FullTrack{SimpleTrack: spotify.SimpleTrack{ID: id, URI: "spotify:track:" + spotify.URI(id)}}})
+			}
+			stub.library.PlaylistTracks["fakeplaylist001"] = items
+			client := newStubClient(t, config)
+
+			// in playlist order, more than a batch of them, each removal checked against the playlist as it is then
+			tracks := []spotify.TrackToRemove{}
+			kept := []string{}
+			for i, item := range items {
+				if test.remove(i) {
+					tracks = append(tracks, spotify.TrackToRemove{URI: string(item.Track.URI), Positions: []int{i}})
+				} else {
+					kept = append(kept, item.Track.ID.String())
+				}
+			}
+			snapshot, err := client.removeTracksFromPlaylistAt(context.Background(), "fakeplaylist001", "snap-001-1", tracks)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if snapshot == "snap-001-1" {
+				t.Error("expected a new snapshot_id")
+			}
+			got := playlistIDs(t, stub.library, "fakeplaylist001")
+			if fmt.Sprint(got) != fmt.Sprint(kept) {
+				t.Errorf("expected %d items kept, got %d: %v", len(kept), len(got), got)
+			}
+		})
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/gdamore/tcell/v2"
+)
+
+// Config is spotui's settings for a profile. They're read, each overriding the one before, from:
+// the defaults, $XDG_CONFIG_HOME/spotui/config.toml, the profile's config.toml, the environment and the flags.
+type Config struct {
+	ClientID string `toml:"client_id"`
+	// ClientSecret is optional, see SpotifyClientBuilderConfig
+	ClientSecret string `toml:"client_secret"`
+	// Scopes replaces the default OAuth scopes when not empty
+	Scopes []string `toml:"scopes"`
+	// CallbackPort is where the login callback is served on 127.0.0.1, 0 picks a free port
+	CallbackPort int `toml:"callback_port"`
+	// TokenStore is auto, secret-service, encrypted or file, see newTokenStore
+	TokenStore string `toml:"token_store"`
+	// TokenFile overrides where the encrypted or file token store keeps the token, each profile's is in a directory
+	// named after it next to where TokenFile points
+	TokenFile string `toml:"token_file"`
+	// CacheDir overrides where library data is cached, each profile's in a directory named after it
+	CacheDir string `toml:"cache_dir"`
+	// Market is the ISO 3166-1 alpha-2 country code tracks are looked up in, "" uses the account's country
+	Market string   `toml:"market"`
+	UI     UIConfig `toml:"ui"`
+}
+
+// UIConfig is the TUI's settings
+type UIConfig struct {
+	// LikedColor is the color of liked tracks, a W3C color name or #rrggbb
+	LikedColor string `toml:"liked_color"`
+	// LogHeight is the number of rows of the LOG pane, 0 gives it a quarter of the screen
+	LogHeight int `toml:"log_height"`
+	// PinnedPlaylists, by name or ID, come first in the PLAYLISTS tree and get one key indexes
+	PinnedPlaylists []string `toml:"pinned_playlists"`
+}
+
+// configEnv maps environment variables to the config keys they override
+var configEnv = map[string]string{
+	"SPOTIFY_ID":            "client_id",
+	"SPOTIFY_SECRET":        "client_secret",
+	"SPOTUI_CALLBACK_PORT":  "callback_port",
+	"SPOTUI_TOKEN_STORE":    "token_store",
+	"SPOTUI_TOKEN_FILE":     "token_file",
+	"SPOTUI_CACHE_DIR":      "cache_dir",
+	"SPOTUI_MARKET":         "market",
+	"SPOTUI_UI_LIKED_COLOR": "ui.liked_color",
+}
+
+// configFlags maps flags to the config keys they override
+var configFlags = map[string]string{
+	"port":        "callback_port",
+	"token-store": "token_store",
+	"cache-dir":   "cache_dir",
+	"market":      "market",
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		CallbackPort: 8080,
+		TokenStore:   tokenStoreAuto,
+		UI:           UIConfig{LikedColor: "lightblue"},
+	}
+}
+
+// addConfigFlags defines the flags that override the config file
+func addConfigFlags(flags *flag.FlagSet) {
+	flags.String("port", "", "the port to serve the login callback on, 0 picks a free one (config: callback_port)")
+	flags.String("token-store", "", "where to keep the login: auto, secret-service, encrypted or file as plain JSON (config: token_store)")
+	flags.String("cache-dir", "", "where to cache library data (config: cache_dir)")
+	flags.String("market", "", "the country code tracks are looked up in, instead of the account's country (config: market)")
+}
+
+// loadConfig reads a profile's config and applies the environment and any flags that were set
+func loadConfig(roots *profileRoots, profile *Profile, flags *flag.FlagSet) (*Config, error) {
+	c := defaultConfig()
+	for _, path := range []string{roots.configFile(), filepath.Join(profile.Dir, "config.toml")} {
+		meta, err := toml.DecodeFile(path, c)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to read config: %v", err)
+		}
+		if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+			return nil, fmt.Errorf("unknown setting %s in %s", undecoded[0], path)
+		}
+	}
+	for env, key := range configEnv {
+		if value, ok := os.LookupEnv(env); ok && value != "" {
+			if err := c.set(key, value); err != nil {
+				return nil, fmt.Errorf("%s: %v", env, err)
+			}
+		}
+	}
+	var err error
+	if flags != nil {
+		flags.Visit(func(f *flag.Flag) {
+			if key, ok := configFlags[f.Name]; ok && err == nil {
+				err = c.set(key, f.Value.String())
+				if err != nil {
+					err = fmt.Errorf("-%s: %v", f.Name, err)
+				}
+			}
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return c, c.validate()
+}
+
+// set overrides a setting from a string, as given in the environment or a flag
+func (c *Config) set(key string, value string) error {
+	switch key {
+	case "client_id":
+		c.ClientID = value
+	case "client_secret":
+		c.ClientSecret = value
+	case "callback_port":
+		port, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid port %q", value)
+		}
+		c.CallbackPort = port
+	case "token_store":
+		c.TokenStore = value
+	case "token_file":
+		c.TokenFile = value
+	case "cache_dir":
+		c.CacheDir = value
+	case "market":
+		c.Market = value
+	case "ui.liked_color":
+		c.UI.LikedColor = value
+	default:
+		return fmt.Errorf("unknown setting %s", key)
+	}
+	return nil
+}
+
+func (c *Config) validate() error {
+	if c.CallbackPort < 0 || c.CallbackPort > 65535 {
+		return fmt.Errorf("invalid callback_port %d", c.CallbackPort)
+	}
+	if c.Market != "" && len(c.Market) != 2 {
+		return fmt.Errorf("invalid market %q, it should be a two letter country code", c.Market)
+	}
+	c.Market = strings.ToUpper(c.Market)
+	if c.UI.LikedColor != "" && tcell.GetColor(c.UI.LikedColor) == tcell.ColorDefault {
+		return fmt.Errorf("invalid ui.liked_color %q", c.UI.LikedColor)
+	}
+	if c.UI.LogHeight < 0 {
+		return fmt.Errorf("invalid ui.log_height %d", c.UI.LogHeight)
+	}
+	return nil
+}
+
+// clientConfig is the configuration for a SpotifyClientBuilder
+func (c *Config) clientConfig() *SpotifyClientBuilderConfig {
+	config := DefaultSpotifyClientBuilderConfig()
+	config.ClientID = c.ClientID
+	config.ClientSecret = c.ClientSecret
+	if len(c.Scopes) > 0 {
+		config.Scopes = c.Scopes
+	}
+	config.LocalPort = strconv.Itoa(c.CallbackPort)
+	return config
+}
+
+// applyTo points the profile at the configured paths. They may be shared by all profiles, e.g. set in the
+// environment, so the profile's name is joined onto them to keep each profile's login and cache apart.
+func (c *Config) applyTo(profile *Profile) error {
+	if c.CacheDir != "" {
+		profile.CacheDir = filepath.Join(c.CacheDir, profile.Name)
+	}
+	profile.tokenFile = ""
+	if c.TokenFile != "" {
+		dir := filepath.Join(filepath.Dir(c.TokenFile), profile.Name)
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return fmt.Errorf("unable to create token dir: %v", err)
+		}
+		profile.tokenFile = filepath.Join(dir, filepath.Base(c.TokenFile))
+	}
+	return nil
+}
+
+// likedColor is the color liked tracks are shown in
+func (c *Config) likedColor() tcell.Color {
+	if c.UI.LikedColor == "" {
+		return tcell.ColorLightBlue
+	}
+	return tcell.GetColor(c.UI.LikedColor)
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/zmb3/spotify"
+)
+
+// FakeLibrary is an in-memory MusicLibrary, useful for running the UI without the Spotify Web API
+type FakeLibrary struct {
+	mu              sync.Mutex
+	UserID          string                             `json:"user_id"`
+	SavedTracks     []spotify.SavedTrack               `json:"saved_tracks"`
+	Playlists       []spotify.SimplePlaylist           `json:"playlists"`
+	PlaylistTracks  map[string][]spotify.PlaylistTrack `json:"playlist_tracks"`
+	FollowedArtists []spotify.FullArtist               `json:"followed_artists"`
+	ArtistAlbums    map[string][]spotify.SimpleAlbum   `json:"artist_albums"`
+	AlbumTracks     map[string][]spotify.SimpleTrack   `json:"album_tracks"`
+	TopTracks       map[string][]spotify.FullTrack     `json:"top_tracks"`
+	RelatedArtists  map[string][]spotify.FullArtist    `json:"related_artists"`
+	Descriptions    map[string]string                  `json:"descriptions"`
+	revision        int
+}
+
+// NewFakeLibrary creates a FakeLibrary from a JSON fixture
+func NewFakeLibrary(jsonFixture []byte) (*FakeLibrary, error) {
+	f := &FakeLibrary{}
+	err := json.Unmarshal(jsonFixture, f)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse fixture: %v", err)
+	}
+	if f.PlaylistTracks == nil {
+		f.PlaylistTracks = map[string][]spotify.PlaylistTrack{}
+	}
+	if f.Descriptions == nil {
+		f.Descriptions = map[string]string{}
+	}
+	return f, nil
+}
+
+// NewFakeLibraryFromFile creates a FakeLibrary from a JSON fixture file
+func NewFakeLibraryFromFile(path string) (*FakeLibrary, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return NewFakeLibrary(b)
+}
+
+func (f *FakeLibrary) removeTrackFromPlaylist(ctx context.Context, id string, track string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if id == "" {
+		kept := []spotify.SavedTrack{}
+		for _, item := range f.SavedTracks {
+			if item.ID.String() != track {
+				kept = append(kept, item)
+			}
+		}
+		f.SavedTracks = kept
+		return nil
+	}
+	items, ok := f.PlaylistTracks[id]
+	if !ok {
+		return fmt.Errorf("playlist %s not found", id)
+	}
+	kept := []spotify.PlaylistTrack{}
+	for _, item := range items {
+		if item.Track.ID.String() != track {
+			kept = append(kept, item)
+		}
+	}
+	f.PlaylistTracks[id] = kept
+	f.bumpSnapshot(id)
+	return nil
+}
+
+// removeTracksFromPlaylistAt checks every item is where it's said to be, rejecting the request with a
+// spotify.Error like Spotify does. The fake keeps no history, so only the current snapshot_id is accepted.
+func (f *FakeLibrary) removeTracksFromPlaylistAt(ctx context.Context, id string, snapshot string, tracks []spotify.TrackToRemove) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	items, ok := f.PlaylistTracks[id]
+	if !ok {
+		return "", fmt.Errorf("playlist %s not found", id)
+	}
+	if snapshot != "" && snapshot != f.snapshotID(id) {
+		return "", spotify.Error{Message: fmt.Sprintf("playlist %s has changed since snapshot %s", id, snapshot), Status: http.StatusBadRequest}
+	}
+	remove := map[int]bool{}
+	for _, track := range tracks {
+		for _, position := range track.Positions {
+			if position < 0 || position >= len(items) || string(items[position].Track.URI) != track.URI {
+				return "", spotify.Error{Message: fmt.Sprintf("%s is not at position %d", track.URI, position), Status: http.StatusBadRequest}
+			}
+			remove[position] = true
+		}
+	}
+	kept := []spotify.PlaylistTrack{}
+	for i, item := range items {
+		if !remove[i] {
+			kept = append(kept, item)
+		}
+	}
+	f.PlaylistTracks[id] = kept
+	f.bumpSnapshot(id)
+	return f.snapshotID(id), nil
+}
+
+func (f *FakeLibrary) addTrackToPlaylist(ctx context.Context, id string, track string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	full, ok := f.findTrack(spotify.ID(track))
+	if !ok {
+		return fmt.Errorf("track %s not found", track)
+	}
+	if id == "" {
+		// liking a track that's already liked changes nothing, like Spotify
+		for _, item := range f.SavedTracks {
+			if item.ID == full.ID {
+				return nil
+			}
+		}
+		f.SavedTracks = append(f.SavedTracks, spotify.SavedTrack{FullTrack: full})
+		return nil
+	}
+	if _, ok := f.PlaylistTracks[id]; !ok {
+		return fmt.Errorf("playlist %s not found", id)
+	}
+	f.PlaylistTracks[id] = append(f.PlaylistTracks[id], spotify.PlaylistTrack{Track: full})
+	f.bumpSnapshot(id)
+	return nil
+}
+
+func (f *FakeLibrary) addTracksToPlaylist(ctx context.Context, id string, tracks []string) error {
+	for _, track := range tracks {
+		if err := f.addTrackToPlaylist(ctx, id, track); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *FakeLibrary) removeTracksFromPlaylist(ctx context.Context, id string, tracks []string) error {
+	for _, track := range tracks {
+		if err := f.removeTrackFromPlaylist(ctx, id, track); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reorderPlaylistTracks only accepts the current snapshot_id, like removeTracksFromPlaylistAt
+func (f *FakeLibrary) reorderPlaylistTracks(ctx context.Context, id string, snapshot string, start int, length int, insertBefore int) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	items, ok := f.PlaylistTracks[id]
+	if !ok {
+		return "", fmt.Errorf("playlist %s not found", id)
+	}
+	if snapshot != "" && snapshot != f.snapshotID(id) {
+		return "", spotify.Error{Message: fmt.Sprintf("playlist %s has changed since snapshot %s", id, snapshot), Status: http.StatusBadRequest}
+	}
+	if start < 0 || length < 1 || start+length > len(items) || insertBefore < 0 || insertBefore > len(items) {
+		return "", fmt.Errorf("can't move %d items from %d to %d in playlist %s", length, start, insertBefore, id)
+	}
+	f.PlaylistTracks[id] = reorder(items, start, length, insertBefore)
+	f.bumpSnapshot(id)
+	return f.snapshotID(id), nil
+}
+
+// createPlaylist adds a playlist owned by the user
+func (f *FakeLibrary) createPlaylist(ctx context.Context, details playlistDetails) (spotify.SimplePlaylist, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	id := ""
+	for n := len(f.Playlists) + 1; id == "" || f.PlaylistTracks[id] != nil; n++ {
+		id = fmt.Sprintf("fakeplaylist%03d", n)
+	}
+	playlist := spotify.SimplePlaylist{ID: spotify.ID(id), Name: details.Name, Owner: spotify.User{ID: f.UserID}}
+	playlist.IsPublic = details.Access == accessPublic
+	playlist.Collaborative = details.Access == accessCollaborative
+	f.Playlists = append(f.Playlists, playlist)
+	f.PlaylistTracks[id] = []spotify.PlaylistTrack{}
+	f.Descriptions[id] = details.Description
+	f.bumpSnapshot(id)
+	return f.Playlists[len(f.Playlists)-1], nil
+}
+
+func (f *FakeLibrary) changePlaylist(ctx context.Context, id string, details playlistDetails) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i := range f.Playlists {
+		if f.Playlists[i].ID.String() == id {
+			f.Playlists[i].Name = details.Name
+			f.Playlists[i].IsPublic = details.Access == accessPublic
+			f.Playlists[i].Collaborative = details.Access == accessCollaborative
+			f.Descriptions[id] = details.Description
+			f.bumpSnapshot(id)
+			return nil
+		}
+	}
+	return fmt.Errorf("playlist %s not found", id)
+}
+
+func (f *FakeLibrary) deletePlaylist(ctx context.Context, id string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i := range f.Playlists {
+		if f.Playlists[i].ID.String() == id {
+			f.Playlists = append(f.Playlists[:i:i], f.Playlists[i+1:]...)
+			delete(f.PlaylistTracks, id)
+			delete(f.Descriptions, id)
+			return nil
+		}
+	}
+	return fmt.Errorf("playlist %s not found", id)
+}
+
+func (f *FakeLibrary) getPlaylistDescription(ctx context.Context, id string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.PlaylistTracks[id]; !ok {
+		return "", fmt.Errorf("playlist %s not found", id)
+	}
+	return f.Descriptions[id], nil
+}
+
+func (f *FakeLibrary) getAllSavedTracks(ctx context.Context, progress func(fetched int, total int)) ([]spotify.SavedTrack, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	all := append([]spotify.SavedTrack{}, f.SavedTracks...)
+	sort.Sort(bySavedTrack(all))
+	if progress != nil {
+		progress(len(all), len(all))
+	}
+	return all, nil
+}
+
+func (f *FakeLibrary) getAllPlaylistsForUser(ctx context.Context) ([]spotify.SimplePlaylist, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	all := []spotify.SimplePlaylist{}
+	for _, item := range f.Playlists {
+		if item.Owner.ID == f.UserID {
+			all = append(all, item)
+		}
+	}
+	return all, nil
+}
+
+// getAllSongsByPlaylist lists the playlist as one page
+func (f *FakeLibrary) getAllSongsByPlaylist(ctx context.Context, id string, page func(items []spotify.PlaylistTrack)) ([]spotify.PlaylistTrack, error) {
+	f.mu.Lock()
+	items := append([]spotify.PlaylistTrack{}, f.PlaylistTracks[id]...)
+	f.mu.Unlock()
+	if page != nil {
+		page(items)
+	}
+	return items, nil
+}
+
+func (f *FakeLibrary) getAllSongsByAlbum(ctx context.Context, id string) ([]spotify.SimpleTrack, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]spotify.SimpleTrack{}, f.AlbumTracks[id]...), nil
+}
+
+func (f *FakeLibrary) getAllAlbumsByArtist(ctx context.Context, id string) ([]spotify.SimpleAlbum, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	all := append([]spotify.SimpleAlbum{}, f.ArtistAlbums[id]...)
+	sort.Sort(byAlbumYear(all))
+	return all, nil
+}
+
+func (f *FakeLibrary) getRelatedArtists(ctx context.Context, id string) ([]spotify.FullArtist, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]spotify.FullArtist{}, f.RelatedArtists[id]...), nil
+}
+
+func (f *FakeLibrary) getAllFollowedArtists(ctx context.Context) ([]spotify.FullArtist, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	all := append([]spotify.FullArtist{}, f.FollowedArtists...)
+	sort.Sort(byArtistName(all))
+	return all, nil
+}
+
+func (f *FakeLibrary) getPopularTracks(ctx context.Context, id string) ([]spotify.FullTrack, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]spotify.FullTrack{}, f.TopTracks[id]...), nil
+}
+
+// bumpSnapshot gives a modified playlist a new snapshot ID, caller must hold the lock
+func (f *FakeLibrary) bumpSnapshot(id string) {
+	f.revision++
+	for i := range f.Playlists {
+		if f.Playlists[i].ID.String() == id {
+			f.Playlists[i].SnapshotID = fmt.Sprintf("%s-%d", id, f.revision)
+			f.Playlists[i].Tracks.Total = uint(len(f.PlaylistTracks[id]))
+		}
+	}
+}
+
+// snapshotID is a playlist's current snapshot_id, caller must hold the lock
+func (f *FakeLibrary) snapshotID(id string) string {
+	for _, item := range f.Playlists {
+		if item.ID.String() == id {
+			return item.SnapshotID
+		}
+	}
+	return ""
+}
+
+// findTrack looks up a track anywhere in the fixture, caller must hold the lock
+func (f *FakeLibrary) findTrack(id spotify.ID) (spotify.FullTrack, bool) {
+	for _, item := range f.SavedTracks {
+		if item.ID == id {
+			return item.FullTrack, true
+		}
+	}
+	for _, items := range f.PlaylistTracks {
+		for _, item := range items {
+			if item.Track.ID == id {
+				return item.Track, true
+			}
+		}
+	}
+	for _, items := range f.TopTracks {
+		for _, item := range items {
+			if item.ID == id {
+				return item, true
+			}
+		}
+	}
+	for _, items := range f.AlbumTracks {
+		for _, item := range items {
+			if item.ID == id {
+				return spotify.FullTrack{SimpleTrack: item}, true
+			}
+		}
+	}
+	return spotify.FullTrack{}, false
+}
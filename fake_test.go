@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/zmb3/spotify"
+)
+
+func TestFakeLibraryChecksSnapshots(t *testing.T) {
+	ctx := context.Background()
+	fake, err := NewFakeLibraryFromFile("fixtures/library.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the last track moves to the top
+	snapshot, err := fake.reorderPlaylistTracks(ctx, "fakeplaylist001", "snap-001-1", 4, 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fake.reorderPlaylistTracks(ctx, "fakeplaylist001", "snap-001-1", 0, 1, 2); err == nil {
+		t.Error("expected moving as of the old snapshot to be rejected")
+	}
+	if _, err := fake.removeTracksFromPlaylistAt(ctx, "fakeplaylist001", "snap-001-1",
+		[]spotify.TrackToRemove{{URI: "spotify:track:faketrack00002", Positions: []int{0}}}); err == nil {
+		t.Error("expected removing as of the old snapshot to be rejected")
+	}
+	if _, err := fake.removeTracksFromPlaylistAt(ctx, "fakeplaylist001", snapshot,
+		[]spotify.TrackToRemove{{URI: "spotify:track:faketrack00002", Positions: []int{2}}}); err == nil {
+		t.Error("expected removing a track that isn't at the position to be rejected")
+	}
+	next, err := fake.removeTracksFromPlaylistAt(ctx, "fakeplaylist001", snapshot,
+		[]spotify.TrackToRemove{{URI: "spotify:track:faketrack00002", Positions: []int{1}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next == snapshot {
+		t.Error("expected a new snapshot_id")
+	}
+	ids := playlistIDs(t, fake, "fakeplaylist001")
+	if got := strings.Join(ids, ","); got != "faketrack00002,faketrack00015,faketrack00021,faketrack00028" {
+		t.Errorf("expected the moved copy of the track to be kept, got %s", got)
+	}
+}
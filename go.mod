@@ -3,22 +3,24 @@ module cleverswine.net/spotui
 go 1.19
 
 require (
+	github.com/BurntSushi/toml v1.2.1
 	github.com/gdamore/tcell v1.4.0
+	github.com/gdamore/tcell/v2 v2.5.3
 	github.com/rivo/tview v0.0.0-20230101141202-1dc4a83affeb
 	github.com/zmb3/spotify v1.3.0
+	golang.org/x/crypto v0.4.0
 	golang.org/x/oauth2 v0.3.0
+	golang.org/x/term v0.3.0
 )
 
 require (
 	github.com/gdamore/encoding v1.0.0 // indirect
-	github.com/gdamore/tcell/v2 v2.5.3 // indirect
 	github.com/golang/protobuf v1.5.2 // indirect
 	github.com/lucasb-eyer/go-colorful v1.2.0 // indirect
 	github.com/mattn/go-runewidth v0.0.14 // indirect
 	github.com/rivo/uniseg v0.4.3 // indirect
 	golang.org/x/net v0.4.0 // indirect
 	golang.org/x/sys v0.3.0 // indirect
-	golang.org/x/term v0.3.0 // indirect
 	golang.org/x/text v0.5.0 // indirect
 	google.golang.org/appengine v1.6.7 // indirect
 	google.golang.org/protobuf v1.28.0 // indirect
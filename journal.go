@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zmb3/spotify"
+)
+
+// pendingOp is a playlist change made offline, waiting to be sent to Spotify
+type pendingOp struct {
+	Op       string    `json:"op"`       // "add" or "remove"
+	Playlist string    `json:"playlist"` // "" for the liked tracks
+	Track    string    `json:"track"`
+	At       time.Time `json:"at"`
+	// URI, Positions and Snapshot are set for removing the items at Positions as of Snapshot instead of by Track
+	URI       string `json:"uri,omitempty"`
+	Positions []int  `json:"positions,omitempty"`
+	Snapshot  string `json:"snapshot,omitempty"`
+}
+
+func (op pendingOp) String() string {
+	target := "playlist " + op.Playlist
+	if op.Playlist == "" {
+		target = "library"
+	}
+	if op.Op == "add" {
+		return fmt.Sprintf("add track %s to %s", op.Track, target)
+	}
+	if len(op.Positions) > 0 {
+		return fmt.Sprintf("remove %s at %v from %s", op.URI, op.Positions, target)
+	}
+	return fmt.Sprintf("remove track %s from %s", op.Track, target)
+}
+
+// journal is an append-only file of pending operations, one JSON object per line
+type journal struct {
+	path string
+	mu   sync.Mutex
+}
+
+func (j *journal) append(op pendingOp) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	b, err := json.Marshal(op)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(j.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(b, '\n'))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (j *journal) load() ([]pendingOp, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	f, err := os.Open(j.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	ops := []pendingOp{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		op := pendingOp{}
+		if err := json.Unmarshal([]byte(line), &op); err != nil {
+			return nil, fmt.Errorf("corrupt journal %s: %v", j.path, err)
+		}
+		ops = append(ops, op)
+	}
+	return ops, scanner.Err()
+}
+
+// replace rewrites the journal with ops, removing it when there are none left
+func (j *journal) replace(ops []pendingOp) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if len(ops) == 0 {
+		err := os.Remove(j.path)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	lines := []string{}
+	for _, op := range ops {
+		b, err := json.Marshal(op)
+		if err != nil {
+			return err
+		}
+		lines = append(lines, string(b))
+	}
+	return writeFileAtomic(j.path, []byte(strings.Join(lines, "\n")+"\n"), 0600)
+}
+
+// replayJournal sends the operations recorded offline to Spotify. Operations that no longer apply, like adding a
+// track that's already there, are reported as conflicts and dropped. If Spotify can't be reached the rest are kept.
+func (c *cachedLibrary) replayJournal(ctx context.Context) error {
+	ops, err := c.journal.load()
+	if err != nil || len(ops) == 0 {
+		return err
+	}
+	c.report(fmt.Sprintf("replaying %d offline changes", len(ops)))
+	contents := map[string]map[string]bool{} // playlist ID -> track IDs currently in it
+	for i, op := range ops {
+		tracks, ok := contents[op.Playlist]
+		if !ok {
+			tracks, err = c.trackIDs(ctx, op.Playlist)
+			if _, rejected := err.(spotify.Error); rejected {
+				c.report(fmt.Sprintf("conflict: skipped %s: %v", op, err))
+				continue
+			}
+			if err != nil {
+				c.report(fmt.Sprintf("unable to replay offline changes, %d left for next time: %v", len(ops)-i, err))
+				return c.journal.replace(ops[i:])
+			}
+			contents[op.Playlist] = tracks
+		}
+		switch {
+		case op.Op == "remove" && len(op.Positions) > 0:
+			// Spotify checks the item is still where it was, there may be other copies of the track
+			_, err = c.removeTracksFromPlaylistAt(ctx, op.Playlist, op.Snapshot, []spotify.TrackToRemove{{URI: op.URI, Positions: op.Positions}})
+		case op.Op == "add" && tracks[op.Track]:
+			c.report(fmt.Sprintf("conflict: skipped %s, it is already there", op))
+			continue
+		case op.Op == "remove" && !tracks[op.Track]:
+			c.report(fmt.Sprintf("conflict: skipped %s, it is no longer there", op))
+			continue
+		case op.Op == "add":
+			err = c.addTrackToPlaylist(ctx, op.Playlist, op.Track)
+			tracks[op.Track] = true
+		case op.Op == "remove":
+			err = c.removeTrackFromPlaylist(ctx, op.Playlist, op.Track)
+			delete(tracks, op.Track)
+		}
+		if err != nil {
+			if _, rejected := err.(spotify.Error); rejected {
+				c.report(fmt.Sprintf("conflict: Spotify rejected %s: %v", op, err))
+				continue
+			}
+			c.report(fmt.Sprintf("unable to replay offline changes, %d left for next time: %v", len(ops)-i, err))
+			return c.journal.replace(ops[i:])
+		}
+		c.report(fmt.Sprintf("replayed %s", op))
+	}
+	return c.journal.replace(nil)
+}
+
+// trackIDs lists what's in a playlist (or the liked tracks) right now, bypassing the cache
+func (c *cachedLibrary) trackIDs(ctx context.Context, playlist string) (map[string]bool, error) {
+	ids := map[string]bool{}
+	if playlist == "" {
+		items, err := c.library.getAllSavedTracks(ctx, nil)
+		for _, item := range items {
+			ids[item.ID.String()] = true
+		}
+		return ids, err
+	}
+	items, err := c.library.getAllSongsByPlaylist(ctx, playlist, nil)
+	for _, item := range items {
+		ids[item.Track.ID.String()] = true
+	}
+	return ids, err
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// replayCache is a cachedLibrary over library with ops journaled, collecting what the replay reports
+func replayCache(t *testing.T, library MusicLibrary, ops ...pendingOp) (*cachedLibrary, *[]string) {
+	t.Helper()
+	reported := &[]string{}
+	c, err := newCachedLibrary(library, t.TempDir(), "", false, func(message string) {
+		*reported = append(*reported, message)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, op := range ops {
+		if err := c.journal.append(op); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return c, reported
+}
+
+func countPrefixed(messages []string, prefix string) int {
+	n := 0
+	for _, message := range messages {
+		if strings.HasPrefix(message, prefix) {
+			n++
+		}
+	}
+	return n
+}
+
+func playlistIDs(t *testing.T, library MusicLibrary, id string) []string {
+	t.Helper()
+	items, err := library.getAllSongsByPlaylist(context.Background(), id, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := []string{}
+	for _, item := range items {
+		ids = append(ids, item.Track.ID.String())
+	}
+	return ids
+}
+
+func TestReplayJournalSkipsConflicts(t *testing.T) {
+	fake, err := NewFakeLibraryFromFile("fixtures/library.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, reported := replayCache(t, fake,
+		pendingOp{Op: "add", Playlist: "fakeplaylist001", Track: "faketrack00015"},
+		pendingOp{Op: "remove", Playlist: "fakeplaylist002", Track: "faketrack00003"},
+		pendingOp{Op: "add", Playlist: "fakeplaylist002", Track: "faketrack00003"},
+		pendingOp{Op: "remove", Playlist: "", Track: "faketrack00028"},
+		// the first add is in the playlist by the time the second one is replayed
+		pendingOp{Op: "add", Playlist: "fakeplaylist002", Track: "faketrack00003"},
+	)
+	if err := c.replayJournal(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := countPrefixed(*reported, "conflict:"); n != 3 {
+		t.Errorf("expected 3 conflicts, got %q", *reported)
+	}
+	if ids := playlistIDs(t, fake, "fakeplaylist001"); len(ids) != 5 {
+		t.Errorf("expected the track already there not to be added again, got %v", ids)
+	}
+	if ids := playlistIDs(t, fake, "fakeplaylist002"); ids[len(ids)-1] != "faketrack00003" || ids[len(ids)-2] == "faketrack00003" {
+		t.Errorf("expected the track to be added once, got %v", ids)
+	}
+	saved, _ := fake.getAllSavedTracks(context.Background(), nil)
+	if savedIDs(saved)["faketrack00028"] {
+		t.Error("expected the track to be unliked")
+	}
+	if ops, _ := c.journal.load(); len(ops) != 0 {
+		t.Errorf("expected the journal to be emptied, got %v", ops)
+	}
+}
+
+// unreachableLibrary fails to add tracks, like a Spotify that can't be reached
+type unreachableLibrary struct {
+	*FakeLibrary
+}
+
+func (u unreachableLibrary) addTrackToPlaylist(ctx context.Context, id string, track string) error {
+	return errors.New("network is unreachable")
+}
+
+func TestReplayJournalKeepsUnsentOps(t *testing.T) {
+	fake, err := NewFakeLibraryFromFile("fixtures/library.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ops := []pendingOp{
+		{Op: "remove", Playlist: "fakeplaylist001", Track: "faketrack00015"},
+		{Op: "add", Playlist: "fakeplaylist001", Track: "faketrack00003"},
+		{Op: "remove", Playlist: "fakeplaylist001", Track: "faketrack00021"},
+	}
+	c, _ := replayCache(t, unreachableLibrary{fake}, ops...)
+	if err := c.replayJournal(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	left, err := c.journal.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(left) != 2 || left[0].Track != "faketrack00003" || left[1].Track != "faketrack00021" {
+		t.Errorf("expected the add and what follows it to be kept, got %v", left)
+	}
+	if ids := playlistIDs(t, fake, "fakeplaylist001"); len(ids) != 4 {
+		t.Errorf("expected only the first remove to be sent, got %v", ids)
+	}
+}
+
+func TestReplayJournalRemovesAtPositions(t *testing.T) {
+	fake, err := NewFakeLibraryFromFile("fixtures/library.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	uri := "spotify:track:faketrack00002"
+	c, reported := replayCache(t, fake,
+		// only the second copy of the track is removed
+		pendingOp{Op: "remove", Playlist: "fakeplaylist001", URI: uri, Positions: []int{4}, Snapshot: "snap-001-1"},
+		// the snapshot has changed since, Spotify rejects it
+		pendingOp{Op: "remove", Playlist: "fakeplaylist001", URI: uri, Positions: []int{0}, Snapshot: "snap-001-1"},
+	)
+	if err := c.replayJournal(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	ids := playlistIDs(t, fake, "fakeplaylist001")
+	if len(ids) != 4 || ids[0] != "faketrack00002" {
+		t.Errorf("expected the copy at position 4 to be removed, got %v", ids)
+	}
+	if n := countPrefixed(*reported, "conflict: Spotify rejected"); n != 1 {
+		t.Errorf("expected the stale remove to be rejected, got %q", *reported)
+	}
+	if ops, _ := c.journal.load(); len(ops) != 0 {
+		t.Errorf("expected the journal to be emptied, got %v", ops)
+	}
+}
@@ -1,93 +1,377 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
 	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
 
-	"github.com/gdamore/tcell/v2"
 	"github.com/rivo/tview"
-	"github.com/zmb3/spotify"
 )
 
-var spoqClient *Client
-var logger *log.Logger
-var app *tview.Application
-var library []spotify.SavedTrack
-var playlistChan chan *AddTrackToPlaylist
-
 func main() {
-	// get an authenticated Spotify client
-	spotifyClientBuilder := NewSpotifyClientBuilder(nil)
-	spotifyClient, err := spotifyClientBuilder.GetClient()
-	if err != nil {
-		log.Fatal(err)
+	if len(os.Args) > 1 && os.Args[1] == "login" {
+		if err := runLogin(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
 	}
-	defer spotifyClientBuilder.SaveToken(spotifyClient)
 
-	// client wrapper for high level utils, paging, etc
-	spoqClient = NewSpoqClient(spotifyClient)
-	library, err = spoqClient.getAllSavedTracks()
-	if err != nil {
-		log.Fatal(err)
-	}
+	fixtures := flag.String("fixtures", "", "browse an in-memory library loaded from a JSON fixture instead of Spotify")
+	stub := flag.Bool("stub", false, "serve the -fixtures library from a local stand-in for the Spotify Web API and log in against it")
+	refresh := flag.Bool("refresh", false, "ignore cached library data and download everything again")
+	offline := flag.Bool("offline", false, "browse the last cached library without network access, changes are sent on the next online launch")
+	profileName := flag.String("profile", defaultProfileName, "the Spotify account to use, each profile has its own login and cache")
+	addConfigFlags(flag.CommandLine)
+	flag.Parse()
 
 	// TUI app
-	app = tview.NewApplication()
+	tui := tview.NewApplication()
 
-	// bottom pane for logging
+	// bottom pane for logging, messages written before the TUI starts show up once it does
 	bottom := tview.NewTextView().SetDynamicColors(true).SetRegions(true).SetWordWrap(true).
 		SetChangedFunc(func() {
-			app.Draw()
+			tui.Draw()
 		})
 	bottom.SetTitle("LOG").SetBorder(true)
-	logger = log.New(bottom, "", log.Ltime)
+	logger := log.New(bottom, "", log.Ltime)
+	logMessage := func(message string) {
+		logger.Println(message)
+	}
 
-	// trees
-	playlistChan = make(chan *AddTrackToPlaylist)
-	defer close(playlistChan)
-	playlistTree := buildPlaylistTree()
-	artistTree := buildArtistTree()
+	roots, err := defaultProfileRoots()
+	if err != nil {
+		log.Fatal(err)
+	}
+	var stubServer *StubServer
+	if *stub {
+		stubServer, err = newStubServerFromFile(*fixtures)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer stubServer.Close()
+		// keep the stub's logins and data away from the real ones
+		tempDir, err := ioutil.TempDir("", "spotui-stub")
+		if err != nil {
+			log.Fatal(err)
+		}
+		roots = &profileRoots{config: filepath.Join(tempDir, "profiles"), cache: filepath.Join(tempDir, "cache")}
+	}
+	// set once the TUI owns the terminal
+	var tuiRunning int32
+	passphrase := newPassphrase(func() bool {
+		return atomic.LoadInt32(&tuiRunning) == 0
+	})
+	// stub logins only last as long as the stub
+	stubTokens := map[string]*MemoryTokenStore{}
 
-	// app level key bindings
-	app.SetInputCapture(appKeyBindings(app, artistTree, playlistTree))
+	// openLibrary gets the client for a profile, logging in if allowed and needed.
+	// replay, if not nil, sends changes made offline and is run before the library loads.
+	openLibrary := func(profile *Profile, cfg *Config, login bool) (client MusicLibrary, replay func(ctx context.Context) error, err error) {
+		switch {
+		case *fixtures != "" && !*stub:
+			// offline fake library, no authentication needed
+			client, err = NewFakeLibraryFromFile(*fixtures)
+			return client, nil, err
+		case *offline:
+			// last cached snapshot, changes are journaled until the next online launch
+			client, err = newOfflineLibrary(profile.CacheDir, logMessage)
+			return client, nil, err
+		}
+		config := cfg.clientConfig()
+		config.OnThrottle = logMessage
+		config.OnTokenSaveError = func(err error) {
+			logMessage(err.Error())
+		}
+		if stubServer != nil {
+			useStubServer(stubServer, config)
+			if stubTokens[profile.Name] == nil {
+				stubTokens[profile.Name] = &MemoryTokenStore{}
+			}
+			config.TokenStore = stubTokens[profile.Name]
+		} else {
+			config.TokenStore, err = newTokenStore(cfg.TokenStore, profile, passphrase)
+			if err != nil {
+				return nil, nil, err
+			}
+			err = profile.adoptPlainToken(config.TokenStore)
+			if err != nil {
+				return nil, nil, fmt.Errorf("unable to move the saved token into the token store: %v", err)
+			}
+		}
+		if !login {
+			tok, err := config.TokenStore.Load()
+			if err != nil {
+				return nil, nil, err
+			}
+			if tok == nil {
+				return nil, nil, fmt.Errorf("profile %s is not logged in, run: spotui login -profile %s", profile.Name, profile.Name)
+			}
+		}
+		// get an authenticated Spotify client
+		builder := NewSpotifyClientBuilder(config)
+		spotifyClient, err := builder.GetClient()
+		if err != nil {
+			return nil, nil, err
+		}
+		// look tracks up where the user is, cfg.Market ends up with the one in use
+		cfg.Market, err = userMarket(spotifyClient, cfg.Market)
+		if err != nil {
+			return nil, nil, err
+		}
+		// client wrapper for high level utils, paging, etc, cached on disk
+		cachedClient, err := newCachedLibrary(NewSpoqClient(spotifyClient, builder.HTTPClient(), cfg.Market), profile.CacheDir, cfg.Market, *refresh, logMessage)
+		if err != nil {
+			return nil, nil, err
+		}
+		return cachedClient, cachedClient.replayJournal, nil
+	}
 
-	// layout
-	flex := tview.NewFlex().
-		AddItem(tview.NewFlex().SetDirection(tview.FlexRow).
-			AddItem(tview.NewFlex().SetDirection(tview.FlexColumn).
-				AddItem(artistTree, 0, 1, true).
-				AddItem(playlistTree, 0, 1, false), 0, 3, true).
-			AddItem(bottom, 0, 1, true), 0, 1, false)
+	// the profile being browsed and what's on screen for it, only touched from the UI goroutine once running
+	var current *App
+	var currentRoot tview.Primitive
+	var currentFocus tview.Primitive
+	var currentProfile string
+
+	// start loads a profile in the background, replacing the current one once it's ready. With login set, for the
+	// first profile, it's opened before the TUI runs and failed may be called right away; otherwise failed is called
+	// from the UI goroutine if it can't be loaded.
+	var start func(profile *Profile, login bool, failed func(err error))
+	// switchProfile shows the profile picker
+	switchProfile := func() {
+		names, err := roots.list()
+		if err != nil {
+			logMessage(err.Error())
+			return
+		}
+		previousCapture := tui.GetInputCapture()
+		restore := func() {
+			tui.SetInputCapture(previousCapture)
+			tui.SetRoot(currentRoot, true).SetFocus(currentFocus)
+		}
+		picker := newProfilePicker(names, currentProfile, func(name string) {
+			profile, err := roots.profile(name)
+			if err != nil {
+				logMessage(err.Error())
+				restore()
+				return
+			}
+			logMessage("switching to profile " + name)
+			start(profile, false, func(err error) {
+				logMessage(fmt.Sprintf("unable to switch to profile %s: %v", name, err))
+				restore()
+			})
+		}, restore)
+		// the app key bindings are for the trees, not the picker
+		tui.SetInputCapture(nil)
+		tui.SetRoot(picker, true)
+	}
+	// openProfile reads a profile's config and opens its library
+	openProfile := func(profile *Profile, login bool) (*App, *Config, func(ctx context.Context) error, error) {
+		cfg, err := loadConfig(roots, profile, flag.CommandLine)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		err = cfg.applyTo(profile)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		client, replay, err := openLibrary(profile, cfg, login)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		app := NewApp(tui, client, logger)
+		app.switchProfile = switchProfile
+		app.likedColor = cfg.likedColor()
+		app.market = cfg.Market
+		app.pinnedPlaylists = cfg.UI.PinnedPlaylists
+		return app, cfg, replay, nil
+	}
+	start = func(profile *Profile, login bool, failed func(err error)) {
+		// show progress while the library loads, then swap in the trees
+		loading := tview.NewModal().SetText("Loading liked tracks...")
+		tui.SetInputCapture(nil)
+		tui.SetRoot(loading, true)
+		var app *App
+		var cfg *Config
+		var replay func(ctx context.Context) error
+		if login {
+			// the first profile is opened before the TUI runs, logging in and asking for a passphrase on the terminal
+			var err error
+			app, cfg, replay, err = openProfile(profile, login)
+			if err != nil {
+				failed(err)
+				return
+			}
+		} else {
+			loading.SetText("Opening profile " + profile.Name + "...")
+		}
+		go func() {
+			if app == nil {
+				// opening the token store and looking up the user's market take a while, the TUI is running
+				var err error
+				app, cfg, replay, err = openProfile(profile, login)
+				if err != nil {
+					tui.QueueUpdateDraw(func() {
+						failed(err)
+					})
+					return
+				}
+				tui.QueueUpdateDraw(func() {
+					loading.SetText("Loading liked tracks...")
+				})
+			}
+			if replay != nil {
+				tui.QueueUpdateDraw(func() {
+					loading.SetText("Sending changes made offline...")
+				})
+				if err := replay(context.Background()); err != nil {
+					logMessage(err.Error())
+				}
+			}
+			err := app.loadLibrary(context.Background(), func(fetched int, total int) {
+				tui.QueueUpdateDraw(func() {
+					loading.SetText(fmt.Sprintf("Loading liked tracks... %d / %d", fetched, total))
+				})
+			})
+			if err != nil {
+				app.Close()
+				tui.QueueUpdateDraw(func() {
+					failed(err)
+				})
+				return
+			}
+
+			// trees
+			playlistTree := app.buildPlaylistTree()
+			artistTree := app.buildArtistTree()
+
+			// layout
+			logHeight, logProportion := 0, 1
+			if cfg.UI.LogHeight > 0 {
+				// fixed number of lines plus the border
+				logHeight, logProportion = cfg.UI.LogHeight+2, 0
+			}
+			layout := tview.NewFlex().
+				AddItem(tview.NewFlex().SetDirection(tview.FlexRow).
+					AddItem(tview.NewFlex().SetDirection(tview.FlexColumn).
+						AddItem(artistTree, 0, 1, true).
+						AddItem(playlistTree, 0, 1, false), 0, 3, true).
+					AddItem(bottom, logHeight, logProportion, true), 0, 1, false)
+			// popups like the playlist picker are shown over the layout
+			pages := tview.NewPages().AddPage("layout", layout, true, true)
+			app.pages = pages
+
+			tui.QueueUpdateDraw(func() {
+				if current != nil {
+					current.Close()
+				}
+				current, currentRoot, currentFocus, currentProfile = app, pages, artistTree, profile.Name
+				// app level key bindings
+				tui.SetInputCapture(app.keyBindings(artistTree, playlistTree))
+				tui.SetRoot(pages, true).SetFocus(artistTree)
+			})
+		}()
+	}
+
+	profile, err := roots.profile(*profileName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var startErr error
+	start(profile, true, func(err error) {
+		startErr = err
+		tui.Stop()
+	})
+	if startErr != nil {
+		log.Fatal(startErr)
+	}
 
 	// run
-	if err := app.SetRoot(flex, true).SetFocus(artistTree).Run(); err != nil {
+	atomic.StoreInt32(&tuiRunning, 1)
+	if err := tui.Run(); err != nil {
 		panic(err)
 	}
+	if current != nil {
+		current.Close()
+	}
+	if startErr != nil {
+		log.Fatal(startErr)
+	}
 }
 
-func libraryContains(id spotify.ID) bool {
-	for i := 0; i < len(library); i++ {
-		if library[i].ID == id {
-			return true
-		}
+// runLogin is the login subcommand, it replaces the profile's saved token with a new one
+func runLogin(args []string) error {
+	flags := flag.NewFlagSet("login", flag.ExitOnError)
+	noBrowser := flags.Bool("no-browser", false, "print the login URL and read the URL the browser is redirected to from stdin, e.g. over SSH")
+	profileName := flags.String("profile", defaultProfileName, "the profile to log in to")
+	addConfigFlags(flags)
+	flags.Parse(args)
+
+	roots, err := defaultProfileRoots()
+	if err != nil {
+		return err
+	}
+	profile, err := roots.profile(*profileName)
+	if err != nil {
+		return err
+	}
+	cfg, err := loadConfig(roots, profile, flags)
+	if err != nil {
+		return err
+	}
+	err = cfg.applyTo(profile)
+	if err != nil {
+		return err
+	}
+	config := cfg.clientConfig()
+	config.TokenStore, err = newTokenStore(cfg.TokenStore, profile, newPassphrase(nil))
+	if err != nil {
+		return err
 	}
-	return false
+	spotifyClientBuilder := NewSpotifyClientBuilder(config)
+	if *noBrowser {
+		_, err = spotifyClientBuilder.LoginWithPastedURL(os.Stdin, os.Stdout)
+	} else {
+		_, err = spotifyClientBuilder.Login()
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Println("Logged in to profile", profile.Name)
+	return nil
 }
 
-func appKeyBindings(app *tview.Application, artistTree *tview.TreeView, playlistTree *tview.TreeView) func(key *tcell.EventKey) *tcell.EventKey {
-	return func(key *tcell.EventKey) *tcell.EventKey {
-		if key.Rune() == 'q' {
-			app.Stop()
-			return nil
-		}
-		switch key.Key() {
-		case tcell.KeyTab:
-			if artistTree.HasFocus() {
-				app.SetFocus(playlistTree)
-			} else {
-				app.SetFocus(artistTree)
-			}
-			return nil
+// newStubServerFromFile starts a StubServer for a fixture file
+func newStubServerFromFile(fixtures string) (*StubServer, error) {
+	if fixtures == "" {
+		return nil, errors.New("-stub requires -fixtures")
+	}
+	fake, err := NewFakeLibraryFromFile(fixtures)
+	if err != nil {
+		return nil, err
+	}
+	return NewStubServer(fake), nil
+}
+
+// useStubServer points the client config at a StubServer
+func useStubServer(stubServer *StubServer, config *SpotifyClientBuilderConfig) {
+	config.ClientID = "stub"
+	config.LocalPort = "0"
+	config.APIURL = stubServer.APIURL()
+	config.AccountsURL = stubServer.AccountsURL()
+	config.OpenURL = func(url string) error {
+		// the stub authorizes immediately and redirects back to our callback
+		resp, err := http.Get(url)
+		if err != nil {
+			return err
 		}
-		return key
+		return resp.Body.Close()
 	}
 }
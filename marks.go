@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/rivo/tview"
+	"github.com/zmb3/spotify"
+)
+
+// markPrefix is shown before the label of marked tracks
+const markPrefix = "● "
+
+// markable tells whether n is a track, tracks are the only nodes that can be marked
+func markable(n *Node) bool {
+	return n.ExpandFunc == nil && n.KeyPressFunc != nil
+}
+
+// markKeyPress handles the keys marking tracks and liking them, which work the same in both trees. It returns false
+// for any other key.
+func (a *App) markKeyPress(tree *tview.TreeView, k string) bool {
+	tn := tree.GetCurrentNode()
+	if tn == nil {
+		return false
+	}
+	n := tn.GetReference().(*Node)
+	switch k {
+	case " ":
+		if markable(n) {
+			a.setMark(tn, a.markIndex(tn) < 0)
+			a.lastMark = tn
+		}
+	case "V":
+		a.markThrough(tree, tn)
+	case "*":
+		a.markChildren(tree, tn)
+	case "+":
+		a.like(n, true)
+	case "-":
+		a.like(n, false)
+	default:
+		return false
+	}
+	return true
+}
+
+// markIndex is where tn is in the marks, -1 if it isn't marked
+func (a *App) markIndex(tn *tview.TreeNode) int {
+	for i, mark := range a.marks {
+		if mark == tn {
+			return i
+		}
+	}
+	return -1
+}
+
+// setMark marks or unmarks a track
+func (a *App) setMark(tn *tview.TreeNode, marked bool) {
+	i := a.markIndex(tn)
+	switch {
+	case marked && i < 0:
+		a.marks = append(a.marks, tn)
+	case !marked && i >= 0:
+		a.marks = append(a.marks[:i:i], a.marks[i+1:]...)
+	}
+	tn.SetText(a.nodeText(tn.GetReference().(*Node)))
+}
+
+// nodeText is the text of a track's tree node, showing whether it's marked
+func (a *App) nodeText(n *Node) string {
+	if a.marked(n) {
+		return markPrefix + n.Label
+	}
+	return n.Label
+}
+
+// marked tells whether the track n is marked
+func (a *App) marked(n *Node) bool {
+	for _, mark := range a.marks {
+		if mark.GetReference() == n {
+			return true
+		}
+	}
+	return false
+}
+
+// clearMarks unmarks all the tracks
+func (a *App) clearMarks() {
+	marks := a.marks
+	a.marks = nil
+	a.lastMark = nil
+	for _, tn := range marks {
+		tn.SetText(a.nodeText(tn.GetReference().(*Node)))
+	}
+}
+
+// markThrough marks the tracks from the one last marked to tn, when they're listed together
+func (a *App) markThrough(tree *tview.TreeView, tn *tview.TreeNode) {
+	if !markable(tn.GetReference().(*Node)) {
+		return
+	}
+	parent := parentOf(tree, tn)
+	from, to := -1, -1
+	if a.lastMark != nil && parent != nil {
+		for i, child := range parent.GetChildren() {
+			if child == a.lastMark {
+				from = i
+			}
+			if child == tn {
+				to = i
+			}
+		}
+	}
+	if from < 0 {
+		a.setMark(tn, true)
+	} else {
+		if from > to {
+			from, to = to, from
+		}
+		for _, child := range parent.GetChildren()[from : to+1] {
+			if markable(child.GetReference().(*Node)) {
+				a.setMark(child, true)
+			}
+		}
+	}
+	a.lastMark = tn
+	a.logger.Printf("%d tracks marked", len(a.marks))
+}
+
+// markChildren marks the tracks of an album or playlist, or the tracks listed with the selected one. If they're all
+// marked already they're unmarked.
+func (a *App) markChildren(tree *tview.TreeView, tn *tview.TreeNode) {
+	parent := tn
+	if markable(tn.GetReference().(*Node)) {
+		parent = parentOf(tree, tn)
+	}
+	tracks := []*tview.TreeNode{}
+	marked := true
+	for _, child := range parent.GetChildren() {
+		if markable(child.GetReference().(*Node)) {
+			tracks = append(tracks, child)
+			marked = marked && a.markIndex(child) >= 0
+		}
+	}
+	if len(tracks) == 0 {
+		a.logger.Println("expand it to mark its tracks")
+		return
+	}
+	for _, child := range tracks {
+		a.setMark(child, !marked)
+	}
+	a.logger.Printf("%d tracks marked", len(a.marks))
+}
+
+// parentOf is the parent of tn in tree, nil if it's not there
+func parentOf(tree *tview.TreeView, tn *tview.TreeNode) *tview.TreeNode {
+	var result *tview.TreeNode
+	tree.GetRoot().Walk(func(node, parent *tview.TreeNode) bool {
+		if node == tn {
+			result = parent
+		}
+		return result == nil
+	})
+	return result
+}
+
+// markedTracks are the marked tracks, or n if none are, that can be added by ID: local files, episodes and tracks
+// taken off Spotify are left out, as are second copies of a track
+func (a *App) markedTracks(n *Node) []*Node {
+	nodes := a.markedNodes(n)
+	result := []*Node{}
+	seen := map[string]bool{}
+	for _, node := range nodes {
+		uri, _ := node.Meta["uri"].(string)
+		if node.ID == "" || strings.HasPrefix(uri, "spotify:episode:") || seen[node.ID] {
+			continue
+		}
+		seen[node.ID] = true
+		result = append(result, node)
+	}
+	if skipped := len(nodes) - len(result); skipped > 0 {
+		a.logger.Printf("left out %d tracks that are copies or have no Spotify ID", skipped)
+	}
+	return result
+}
+
+// markedNodes are the marked tracks, or n if none are
+func (a *App) markedNodes(n *Node) []*Node {
+	nodes := []*Node{}
+	for _, tn := range a.marks {
+		nodes = append(nodes, tn.GetReference().(*Node))
+	}
+	if len(nodes) == 0 && markable(n) {
+		nodes = append(nodes, n)
+	}
+	return nodes
+}
+
+// like likes or unlikes the marked tracks, or n if none are marked
+func (a *App) like(n *Node, liked bool) {
+	tracks := []*Node{}
+	for _, track := range a.markedTracks(n) {
+		if a.libraryContains(spotify.ID(track.ID)) != liked {
+			tracks = append(tracks, track)
+		}
+	}
+	a.clearMarks()
+	if len(tracks) == 0 {
+		return
+	}
+	if liked {
+		// through the listener, which lists them in the liked tracks too
+		a.playlistChan <- &AddTrackToPlaylist{Tracks: tracks, PlaylistIndexes: []string{playlistIndex(0)}}
+		return
+	}
+	ids := trackIDs(tracks)
+	a.logger.Printf("removing %d tracks from the liked tracks", len(ids))
+	go func() {
+		err := a.removeTracks(context.Background(), "", ids)
+		a.tui.QueueUpdateDraw(func() {
+			if err != nil {
+				a.logger.Println(err)
+				return
+			}
+			if len(a.playlists) == 0 {
+				return
+			}
+			// show them as removed where they're listed in the liked tracks
+			unliked := map[string]bool{}
+			for _, id := range ids {
+				unliked[id] = true
+			}
+			for _, tn := range a.playlists[0].GetChildren() {
+				if track := tn.GetReference().(*Node); unliked[track.ID] && markable(track) {
+					track.Meta["color"] = tcell.ColorRed
+					tn.SetColor(tcell.ColorRed)
+				}
+			}
+		})
+	}()
+}
+
+// removeNodes removes tracks from the playlists they're listed in, or from the liked tracks, in the background and
+// shows them as removed. Tracks in the ARTISTS tree aren't listed in a playlist and are left alone.
+func (a *App) removeNodes(nodes []*Node) {
+	playlists := []*playlistState{}
+	byPlaylist := map[*playlistState][]*Node{}
+	liked := []*Node{}
+	for _, n := range nodes {
+		if playlist, ok := n.Meta["playlist"].(*playlistState); ok {
+			if byPlaylist[playlist] == nil {
+				playlists = append(playlists, playlist)
+			}
+			byPlaylist[playlist] = append(byPlaylist[playlist], n)
+		} else if id, ok := n.Meta["playlistID"]; ok && id == "" {
+			liked = append(liked, n)
+		}
+	}
+	if len(playlists) == 0 && len(liked) == 0 {
+		a.logger.Println("the tracks aren't listed in a playlist")
+		return
+	}
+	done := func(removed []*Node, err error) {
+		if err != nil {
+			a.logger.Println(err)
+		}
+		a.showRemoved(removed)
+	}
+	for _, playlist := range playlists {
+		a.logger.Printf("removing %d tracks from playlist %s", len(byPlaylist[playlist]), playlist.id)
+		a.removeFromPlaylist(playlist, byPlaylist[playlist], done)
+	}
+	if len(liked) > 0 {
+		ids := trackIDs(liked)
+		a.logger.Printf("removing %d tracks from the liked tracks", len(ids))
+		go func() {
+			err := a.removeTracks(context.Background(), "", ids)
+			a.tui.QueueUpdateDraw(func() {
+				if err != nil {
+					done(nil, err)
+					return
+				}
+				done(liked, nil)
+			})
+		}()
+	}
+}
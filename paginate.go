@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"strconv"
+)
+
+// Paginator walks every page of a Spotify paging object, either by offset or by cursor
+type Paginator[T any] struct {
+	// fetch gets the page at cursor and returns the cursor of the next page, "" when there are no more
+	fetch    func(cursor string) (items []T, next string, total int, err error)
+	progress func(fetched int, total int)
+	// offset paging only, used to fetch pages concurrently once the total is known
+	limit       int
+	fetchOffset func(offset int, limit int) (items []T, total int, more bool, err error)
+	workers     int
+}
+
+// newOffsetPaginator creates a Paginator for endpoints paged with limit and offset
+func newOffsetPaginator[T any](limit int, fetch func(offset int, limit int) (items []T, total int, more bool, err error)) *Paginator[T] {
+	return &Paginator[T]{limit: limit, fetchOffset: fetch, fetch: func(cursor string) ([]T, string, int, error) {
+		offset := 0
+		if cursor != "" {
+			offset, _ = strconv.Atoi(cursor)
+		}
+		items, total, more, err := fetch(offset, limit)
+		if err != nil || !more {
+			return items, "", total, err
+		}
+		return items, strconv.Itoa(offset + limit), total, nil
+	}}
+}
+
+// newCursorPaginator creates a Paginator for endpoints paged with an "after" cursor
+func newCursorPaginator[T any](fetch func(after string) (items []T, next string, total int, err error)) *Paginator[T] {
+	return &Paginator[T]{fetch: fetch}
+}
+
+// OnProgress sets a func that is called after every page with the number of items fetched so far and the total
+func (p *Paginator[T]) OnProgress(f func(fetched int, total int)) *Paginator[T] {
+	p.progress = f
+	return p
+}
+
+// Concurrently fetches the pages after the first one with up to n workers, offset paging only
+func (p *Paginator[T]) Concurrently(n int) *Paginator[T] {
+	p.workers = n
+	return p
+}
+
+// Each calls f with every page in order, stopping early if ctx is done or f returns an error
+func (p *Paginator[T]) Each(ctx context.Context, f func(items []T) error) error {
+	if p.workers > 1 && p.fetchOffset != nil {
+		return p.eachConcurrently(ctx, f)
+	}
+	cursor := ""
+	fetched := 0
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		items, next, total, err := p.fetch(cursor)
+		if err != nil {
+			return err
+		}
+		fetched += len(items)
+		if p.progress != nil {
+			p.progress(fetched, total)
+		}
+		if err := f(items); err != nil {
+			return err
+		}
+		if next == "" {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+// eachConcurrently uses the total from the first page to fetch the remaining offsets with a bounded
+// pool of workers, still calling f with the pages in order
+func (p *Paginator[T]) eachConcurrently(ctx context.Context, f func(items []T) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	items, total, more, err := p.fetchOffset(0, p.limit)
+	if err != nil {
+		return err
+	}
+	fetched := len(items)
+	if p.progress != nil {
+		p.progress(fetched, total)
+	}
+	if err := f(items); err != nil || !more {
+		return err
+	}
+
+	type result struct {
+		items []T
+		err   error
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	pages := (total - 1) / p.limit // not counting the first one
+	if pages < 1 {
+		return nil
+	}
+	results := make([]chan result, pages)
+	jobs := make(chan int, pages)
+	for i := range results {
+		results[i] = make(chan result, 1)
+		jobs <- i
+	}
+	close(jobs)
+	for w := 0; w < p.workers && w < pages; w++ {
+		go func() {
+			for i := range jobs {
+				if err := ctx.Err(); err != nil {
+					results[i] <- result{err: err}
+					continue
+				}
+				items, _, _, err := p.fetchOffset((i+1)*p.limit, p.limit)
+				results[i] <- result{items: items, err: err}
+			}
+		}()
+	}
+	for i := range results {
+		var r result
+		select {
+		case r = <-results[i]:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if r.err != nil {
+			return r.err
+		}
+		fetched += len(r.items)
+		if p.progress != nil {
+			p.progress(fetched, total)
+		}
+		if err := f(r.items); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// All collects the items of every page
+func (p *Paginator[T]) All(ctx context.Context) ([]T, error) {
+	all := []T{}
+	err := p.Each(ctx, func(items []T) error {
+		all = append(all, items...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return all, nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// numbers pages through the numbers from 0 to n-1 by offset, calling fetched with the offset of every page fetched
+func numbers(n int, fetched func(offset int)) func(offset int, limit int) ([]int, int, bool, error) {
+	return func(offset int, limit int) ([]int, int, bool, error) {
+		if fetched != nil {
+			fetched(offset)
+		}
+		items := []int{}
+		for i := offset; i < offset+limit && i < n; i++ {
+			items = append(items, i)
+		}
+		return items, n, offset+limit < n, nil
+	}
+}
+
+func TestPaginatorReportsProgress(t *testing.T) {
+	type call struct{ fetched, total int }
+	for _, workers := range []int{1, 3} {
+		t.Run(fmt.Sprintf("%d workers", workers), func(t *testing.T) {
+			calls := []call{}
+			all, err := newOffsetPaginator(10, numbers(25, nil)).Concurrently(workers).OnProgress(func(fetched int, total int) {
+				calls = append(calls, call{fetched, total})
+			}).All(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(all) != 25 {
+				t.Errorf("expected 25 items, got %v", all)
+			}
+			want := []call{{10, 25}, {20, 25}, {25, 25}}
+			if !reflect.DeepEqual(calls, want) {
+				t.Errorf("expected progress %v, got %v", want, calls)
+			}
+		})
+	}
+}
+
+func TestPaginatorKeepsPagesInOrder(t *testing.T) {
+	fetch := numbers(50, nil)
+	// the later the page, the sooner it's fetched
+	slow := func(offset int, limit int) ([]int, int, bool, error) {
+		time.Sleep(time.Duration(50-offset) * time.Millisecond)
+		return fetch(offset, limit)
+	}
+	all, err := newOffsetPaginator(10, slow).Concurrently(4).All(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, n := range all {
+		if n != i {
+			t.Fatalf("expected the items in order, got %v", all)
+		}
+	}
+	if len(all) != 50 {
+		t.Errorf("expected 50 items, got %d", len(all))
+	}
+}
+
+func TestPaginatorStopsWhenCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var fetches int32
+	// the second page cancels, any fetched with it wait until then
+	p := newOffsetPaginator(10, numbers(1000, func(offset int) {
+		atomic.AddInt32(&fetches, 1)
+		if offset == 10 {
+			cancel()
+		} else if offset > 10 {
+			<-ctx.Done()
+		}
+	})).Concurrently(2)
+	err := p.Each(ctx, func(items []int) error {
+		return nil
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the paging to be cancelled, got %v", err)
+	}
+	// the first page, the one that cancelled and the one the other worker was fetching
+	if n := atomic.LoadInt32(&fetches); n > 3 {
+		t.Errorf("expected fetching to stop once cancelled, got %d of 100 pages fetched", n)
+	}
+}
+
+func TestPaginatorStopsOnError(t *testing.T) {
+	fetch := numbers(100, nil)
+	failing := func(offset int, limit int) ([]int, int, bool, error) {
+		if offset == 20 {
+			return nil, 0, false, errors.New("page failed")
+		}
+		return fetch(offset, limit)
+	}
+	pages := 0
+	err := newOffsetPaginator(10, failing).Concurrently(3).Each(context.Background(), func(items []int) error {
+		pages++
+		return nil
+	})
+	if err == nil || err.Error() != "page failed" {
+		t.Errorf("expected the page's error, got %v", err)
+	}
+	if pages != 2 {
+		t.Errorf("expected the pages before the failed one, got %d", pages)
+	}
+}
+
+func TestCursorPaginator(t *testing.T) {
+	pages := map[string][]string{"": {"a", "b"}, "b": {"c", "d"}, "d": {"e"}}
+	after := []string{}
+	progress := []int{}
+	all, err := newCursorPaginator(func(cursor string) ([]string, string, int, error) {
+		after = append(after, cursor)
+		items := pages[cursor]
+		next := items[len(items)-1]
+		if _, ok := pages[next]; !ok {
+			next = ""
+		}
+		return items, next, 5, nil
+	}).Concurrently(4).OnProgress(func(fetched int, total int) {
+		progress = append(progress, fetched)
+	}).All(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(all, []string{"a", "b", "c", "d", "e"}) {
+		t.Errorf("expected every item in order, got %v", all)
+	}
+	// there's no offset to fetch concurrently, every page follows the last one's cursor
+	if !reflect.DeepEqual(after, []string{"", "b", "d"}) {
+		t.Errorf("expected each page to be fetched after the last one, got %v", after)
+	}
+	if !reflect.DeepEqual(progress, []int{2, 4, 5}) {
+		t.Errorf("expected progress after every page, got %v", progress)
+	}
+}
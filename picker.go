@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/rivo/tview"
+	"github.com/zmb3/spotify"
+)
+
+// playlistPickerKey opens the playlist picker on a track, it isn't one of the playlistKeys
+const playlistPickerKey = "t"
+
+// fuzzyMatch tells whether the letters of pattern appear in order in s, ignoring case. Matches scoring higher
+// have more of the letters together and at the start of words.
+func fuzzyMatch(pattern string, s string) (int, bool) {
+	pattern = strings.ToLower(pattern)
+	runes := []rune(strings.ToLower(s))
+	score, last := 0, -1
+	i := 0
+	for _, p := range pattern {
+		if unicode.IsSpace(p) {
+			continue
+		}
+		for i < len(runes) && runes[i] != p {
+			i++
+		}
+		if i == len(runes) {
+			return 0, false
+		}
+		switch {
+		case i == last+1:
+			score += 3
+		case i == 0 || !unicode.IsLetter(runes[i-1]) && !unicode.IsDigit(runes[i-1]):
+			score += 2
+		default:
+			score -= i - last - 1
+		}
+		last = i
+		i++
+	}
+	return score, true
+}
+
+// pickerItem is a playlist in the picker
+type pickerItem struct {
+	playlist *Node
+	// name is what's filtered on, the label without the playlist's index
+	name string
+	// contains is nil until it's known whether the playlist has all the tracks
+	contains *bool
+	marked   bool
+}
+
+// showPlaylistPicker pops up a list of the playlists, filtered as you type, to add tracks to several at once. Tab
+// marks playlists, Enter adds the tracks to the marked ones (or the highlighted one) and Esc closes it. If move is
+// set the tracks are then removed from the playlists they're listed in.
+func (a *App) showPlaylistPicker(tracks []*Node, move bool) {
+	if a.pages == nil || len(a.playlists) == 0 || len(tracks) == 0 {
+		return
+	}
+	ids := map[string]bool{}
+	for _, track := range tracks {
+		ids[track.ID] = true
+	}
+	items := []*pickerItem{}
+	for _, tn := range a.playlists {
+		playlist := tn.GetReference().(*Node)
+		item := &pickerItem{playlist: playlist, name: strings.TrimPrefix(playlist.Label, playlist.Name+") ")}
+		if playlist.ID == "" {
+			contains := true
+			for id := range ids {
+				contains = contains && a.libraryContains(spotify.ID(id))
+			}
+			item.contains = &contains
+		}
+		items = append(items, item)
+	}
+
+	filter := tview.NewInputField().SetLabel("Filter: ")
+	list := tview.NewList().ShowSecondaryText(false).SetHighlightFullLine(true)
+	layout := tview.NewFlex().SetDirection(tview.FlexRow).
+		AddItem(filter, 1, 0, true).
+		AddItem(list, 0, 1, false)
+	title := fmt.Sprintf("\"%s\"", tview.Escape(tracks[0].Name))
+	if len(tracks) > 1 {
+		title = fmt.Sprintf("%d TRACKS", len(tracks))
+	}
+	if move {
+		title = "MOVE " + title + " TO"
+	} else {
+		title = "ADD " + title + " TO"
+	}
+	layout.SetBorder(true).SetTitle(title)
+
+	// shown are the items matching the filter, best first
+	shown := []*pickerItem{}
+	render := func() {
+		current := list.GetCurrentItem()
+		list.Clear()
+		for _, item := range shown {
+			mark := "[ ]"
+			if item.marked {
+				mark = "[x]"
+			}
+			state := ""
+			switch {
+			case item.contains == nil:
+				state = " [gray]…"
+			case *item.contains:
+				state = " [gray](already added)"
+			}
+			list.AddItem(fmt.Sprintf("%s %s%s", tview.Escape(mark), tview.Escape(item.playlist.Label), state), "", 0, nil)
+		}
+		list.SetCurrentItem(current)
+	}
+	refilter := func(text string) {
+		type match struct {
+			item  *pickerItem
+			score int
+		}
+		matches := []match{}
+		for _, item := range items {
+			if score, ok := fuzzyMatch(text, item.name); ok {
+				matches = append(matches, match{item, score})
+			}
+		}
+		sort.SliceStable(matches, func(i, j int) bool { return matches[i].score > matches[j].score })
+		shown = shown[:0]
+		for _, m := range matches {
+			shown = append(shown, m.item)
+		}
+		list.SetCurrentItem(0)
+		render()
+	}
+	refilter("")
+
+	// find out which playlists already have the tracks, in the background
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		for _, item := range items {
+			if item.playlist.ID == "" {
+				continue
+			}
+			listed, err := a.client.getAllSongsByPlaylist(ctx, item.playlist.ID, nil)
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				a.logger.Println(err)
+				continue
+			}
+			found := map[string]bool{}
+			for _, t := range listed {
+				if ids[t.Track.ID.String()] {
+					found[t.Track.ID.String()] = true
+				}
+			}
+			contains := len(found) == len(ids)
+			item := item
+			a.tui.QueueUpdateDraw(func() {
+				item.contains = &contains
+				render()
+			})
+		}
+	}()
+
+	var closePopup func()
+	closePicker := func() {
+		cancel()
+		closePopup()
+	}
+	filter.SetChangedFunc(refilter)
+	filter.SetInputCapture(func(key *tcell.EventKey) *tcell.EventKey {
+		switch key.Key() {
+		case tcell.KeyEsc:
+			closePicker()
+			return nil
+		case tcell.KeyUp, tcell.KeyDown, tcell.KeyPgUp, tcell.KeyPgDn:
+			// move through the list while typing
+			list.InputHandler()(key, nil)
+			return nil
+		case tcell.KeyTab:
+			if current := list.GetCurrentItem(); current < len(shown) {
+				shown[current].marked = !shown[current].marked
+				render()
+				list.SetCurrentItem(current + 1)
+			}
+			return nil
+		case tcell.KeyEnter:
+			chosen := []*pickerItem{}
+			for _, item := range items {
+				if item.marked {
+					chosen = append(chosen, item)
+				}
+			}
+			if current := list.GetCurrentItem(); len(chosen) == 0 && current < len(shown) {
+				chosen = append(chosen, shown[current])
+			}
+			closePicker()
+			if len(chosen) > 0 {
+				// one event, the listener waits on the UI goroutine between playlists
+				indexes := []string{}
+				for _, item := range chosen {
+					indexes = append(indexes, item.playlist.Name)
+				}
+				a.playlistChan <- &AddTrackToPlaylist{Tracks: tracks, PlaylistIndexes: indexes, Move: move}
+				a.clearMarks()
+			}
+			return nil
+		}
+		return key
+	})
+
+	closePopup = a.showPopup(centered(layout, 60, 20), filter)
+}
@@ -1,125 +1,816 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 
 	"github.com/gdamore/tcell/v2"
 	"github.com/rivo/tview"
+	"github.com/zmb3/spotify"
 )
 
-const playlistIndexes = "abcdefghijklmnopqrsuvwxyz1234567890"
+// playlistKeys add the selected track to a playlist with one key, "a" being the liked tracks. The playlists after
+// them are addressed by a number followed by one of the keys: "1a", "1b", ... "2a", ... "q" quits and "t" opens
+// the playlist picker, so they're left out.
+const playlistKeys = "abcdefghijklmnoprsuvwxyz"
 
-// AddTrackToPlaylist is an event for adding a track to a playlist
+// playlistIndex is the key sequence for the i-th playlist, counting the liked tracks as 0
+func playlistIndex(i int) string {
+	if i < len(playlistKeys) {
+		return string(playlistKeys[i])
+	}
+	i -= len(playlistKeys)
+	return strconv.Itoa(i/len(playlistKeys)+1) + string(playlistKeys[i%len(playlistKeys)])
+}
+
+// pinFirst moves the pinned playlists, given by name or ID, to the front in the order they're pinned, so they get
+// the one key indexes
+func pinFirst(items []spotify.SimplePlaylist, pinned []string) ([]spotify.SimplePlaylist, []string) {
+	result := []spotify.SimplePlaylist{}
+	used := map[int]bool{}
+	missing := []string{}
+	for _, pin := range pinned {
+		found := false
+		for i, item := range items {
+			if !used[i] && (item.Name == pin || item.ID.String() == pin) {
+				result = append(result, item)
+				used[i] = true
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, pin)
+		}
+	}
+	for i, item := range items {
+		if !used[i] {
+			result = append(result, item)
+		}
+	}
+	return result, missing
+}
+
+// AddTrackToPlaylist is an event for adding tracks to one or more playlists
 type AddTrackToPlaylist struct {
-	Track         *Node
-	PlaylistIndex string
+	Tracks          []*Node
+	PlaylistIndexes []string
+	// Move removes the tracks from the playlists they're listed in once they're added to all of them
+	Move bool
+}
+
+// playlistState is what positional changes to a playlist need, shared by the playlist's node and its tracks
+type playlistState struct {
+	id string
+
+	mu sync.Mutex
+	// details are the playlist's name, description and access, the description is "" until it's set from spotui
+	details playlistDetails
+	// snapshot is the snapshot_id the items are as of, "" when they're only known to be current
+	snapshot string
+	// items are the track nodes in playlist order, a node's index is its position
+	items []*Node
+	// inOrder lists the tracks in playlist order rather than sorted, which is the order they can be moved in
+	inOrder bool
+	// loading counts the listings of the tracks in progress, those shown so far have no position until they're all
+	// listed. One cancelled with Esc may still be running.
+	loading int
+	// changing is set while a positional change is sent, the next one needs the positions it leaves
+	changing bool
+}
+
+// errLoading is returned for positional changes to a playlist whose tracks are still being listed
+var errLoading = errors.New("the playlist is still loading")
+
+// errChanging is returned for positional changes to a playlist while the last one is still being sent
+var errChanging = errors.New("the playlist is still being changed")
+
+// position is where a track node is in the playlist and the snapshot that's as of, -1 if it's been removed
+func (p *playlistState) position(n *Node) (int, string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, item := range p.items {
+		if item == n {
+			return i, p.snapshot
+		}
+	}
+	return -1, p.snapshot
+}
+
+// listing records that the playlist's tracks are being listed, until load or failed is called
+func (p *playlistState) listing() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.loading++
+}
+
+// failed records that a listing of the playlist's tracks didn't finish
+func (p *playlistState) failed() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.loading--
+}
+
+// load replaces the track nodes with a new listing of the playlist
+func (p *playlistState) load(items []*Node) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.items = items
+	p.loading--
+}
+
+// isLoading tells whether the playlist's tracks are being listed
+func (p *playlistState) isLoading() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.loading > 0
+}
+
+// startChange records that a positional change is being sent, until endChange is called. There's only one at a
+// time, and none while the tracks are being listed.
+func (p *playlistState) startChange() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch {
+	case p.loading > 0:
+		return errLoading
+	case p.changing:
+		return errChanging
+	}
+	p.changing = true
+	return nil
+}
+
+// endChange records that a positional change has been sent, whether or not it went through
+func (p *playlistState) endChange() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.changing = false
+}
+
+// removed takes track nodes out after they've been removed from the playlist, giving the playlist a new snapshot
+func (p *playlistState) removed(snapshot string, nodes ...*Node) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	gone := map[*Node]bool{}
+	for _, n := range nodes {
+		gone[n] = true
+	}
+	kept := []*Node{}
+	for _, item := range p.items {
+		if !gone[item] {
+			kept = append(kept, item)
+		}
+	}
+	p.items = kept
+	p.snapshot = snapshot
+}
+
+// added records a track added to the end of the playlist, n is nil when the playlist's tracks aren't loaded
+func (p *playlistState) added(n *Node) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if n != nil {
+		p.items = append(p.items, n)
+	}
+	// the add doesn't say what the new snapshot is
+	p.snapshot = ""
+}
+
+// moved records a range of tracks moved within the playlist, see reorder, giving the playlist a new snapshot
+func (p *playlistState) moved(start int, length int, insertBefore int, snapshot string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.items = reorder(p.items, start, length, insertBefore)
+	p.snapshot = snapshot
+}
+
+// tracks are the track nodes in playlist order
+func (p *playlistState) tracks() []*Node {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.items
+}
+
+// ordered tells whether the tracks are listed in playlist order
+func (p *playlistState) ordered() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.inOrder
+}
+
+// toggleOrder switches between listing the tracks in playlist order and sorted, returning whether they're in order
+func (p *playlistState) toggleOrder() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.inOrder = !p.inOrder
+	return p.inOrder
 }
 
-func listPlaylistTracks(n *Node) ([]*Node, error) {
-	items, err := spoqClient.getAllSongsByPlaylist(n.ID)
+// describe is the playlist's details as last known
+func (p *playlistState) describe() playlistDetails {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.details
+}
+
+// changed records new details for the playlist
+func (p *playlistState) changed(details playlistDetails) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.details = details
+}
+
+func (a *App) listPlaylistTracks(ctx context.Context, n *Node, partial func(children []*Node)) ([]*Node, error) {
+	playlist := n.Meta["playlist"].(*playlistState)
+	playlist.listing()
+	// the pages are shown as they arrive, a long playlist takes a while to list
+	listed := []spotify.PlaylistTrack{}
+	nodes := []*Node{}
+	items, err := a.client.getAllSongsByPlaylist(ctx, n.ID, func(items []spotify.PlaylistTrack) {
+		for _, item := range items {
+			listed = append(listed, item)
+			nodes = append(nodes, a.playlistItemToNode(item, playlist))
+		}
+		if partial != nil {
+			partial(playlistOrder(listed, nodes, playlist.ordered()))
+		}
+	})
+	if err == nil {
+		// the last page may have arrived after it was cancelled
+		err = ctx.Err()
+	}
 	if err != nil {
+		playlist.failed()
 		return nil, err
 	}
-	result := []*Node{}
-	for _, item := range items {
-		artist := ""
-		if len(item.Track.Artists) > 0 {
-			artist = item.Track.Artists[0].Name
+	if len(nodes) != len(items) {
+		// cached, they weren't listed a page at a time
+		listed = items
+		nodes = make([]*Node, len(items))
+		for i, item := range items {
+			nodes[i] = a.playlistItemToNode(item, playlist)
 		}
-		label := fmt.Sprintf("%s - %s", artist, item.Track.Name)
-		node := &Node{Name: item.Track.Name, Label: label, ID: item.Track.ID.String(), KeyPressFunc: playlistKeyPress}
-		node.Meta = map[string]interface{}{"playlistID": n.ID}
-		result = append(result, node)
 	}
-	return result, nil
+	playlist.load(nodes)
+	return playlistOrder(listed, nodes, playlist.ordered()), nil
 }
 
-func listPlaylists(n *Node) ([]*Node, error) {
-	items, err := spoqClient.getAllPlaylistsForUser()
+// playlistOrder lists the nodes of a playlist's items in playlist order, or sorted by artist and name
+func playlistOrder(items []spotify.PlaylistTrack, nodes []*Node, ordered bool) []*Node {
+	if ordered {
+		return append([]*Node{}, nodes...)
+	}
+	sorted := make([]playlistItem, len(items))
+	for i, item := range items {
+		sorted[i] = playlistItem{PlaylistTrack: item, Position: i}
+	}
+	sort.Stable(byPlaylistTrack(sorted))
+	result := make([]*Node, len(sorted))
+	for i, item := range sorted {
+		result[i] = nodes[item.Position]
+	}
+	return result
+}
+
+// playlistItemToNode shows local files, episodes and tracks taken off Spotify apart from catalog tracks
+func (a *App) playlistItemToNode(item spotify.PlaylistTrack, playlist *playlistState) *Node {
+	label := fmt.Sprintf("%s - %s", artistName(item.Track.Artists), item.Track.Name)
+	node := &Node{Name: item.Track.Name, Label: label, ID: item.Track.ID.String(), KeyPressFunc: a.playlistKeyPress}
+	node.Meta = map[string]interface{}{"playlistID": playlist.id, "playlist": playlist, "uri": string(item.Track.URI), "track": item.Track}
+	switch itemKind(item) {
+	case localTrack:
+		node.Label = label + " (local file)"
+		node.Meta["color"] = tcell.ColorDarkCyan
+	case podcastEpisode:
+		// episodes come back as tracks with the show as their album
+		node.Label = fmt.Sprintf("%s - %s (episode)", item.Track.Album.Name, item.Track.Name)
+		node.Meta["color"] = tcell.ColorMediumPurple
+	case removedTrack:
+		node.Label = "(removed from Spotify)"
+		node.Meta["color"] = tcell.ColorDarkGray
+	default:
+		if !playable(a.market, item.Track.IsPlayable, item.Track.AvailableMarkets) {
+			dimUnavailable(node)
+		}
+	}
+	return node
+}
+
+func (a *App) listPlaylists(ctx context.Context, n *Node, partial func(children []*Node)) ([]*Node, error) {
+	items, err := a.client.getAllPlaylistsForUser(ctx)
 	if err != nil {
 		return nil, err
 	}
 	// My Library
-	libNode := &Node{Name: string(playlistIndexes[0]), Label: "Library", ID: "", ExpandFunc: func(n *Node) ([]*Node, error) {
+	libNode := &Node{Name: playlistIndex(0), Label: "Library", ID: "", ExpandFunc: func(ctx context.Context, n *Node, partial func(children []*Node)) ([]*Node, error) {
 		result := []*Node{}
-		for _, item := range library {
-			artist := ""
-			if len(item.Artists) > 0 {
-				artist = item.Artists[0].Name
-			}
-			label := fmt.Sprintf("%s - %s", artist, item.Name)
-			node := &Node{Name: item.Name, Label: label, ID: item.ID.String(), KeyPressFunc: playlistKeyPress}
-			node.Meta = map[string]interface{}{"playlistID": n.ID}
+		for _, item := range a.savedTracks() {
+			label := fmt.Sprintf("%s - %s", artistName(item.Artists), item.Name)
+			node := &Node{Name: item.Name, Label: label, ID: item.ID.String(), KeyPressFunc: a.playlistKeyPress}
+			node.Meta = map[string]interface{}{"playlistID": n.ID, "track": item.FullTrack}
+			if !playable(a.market, item.IsPlayable, item.AvailableMarkets) {
+				dimUnavailable(node)
+			}
 			result = append(result, node)
 		}
 		return result, nil
-	}}
+	}, KeyPressFunc: a.playlistNodeKeyPress}
 	result := []*Node{libNode}
-	// Other user playlists
+	// Other user playlists, the pinned ones first
+	items, missing := pinFirst(items, a.pinnedPlaylists)
+	for _, pin := range missing {
+		a.logger.Printf("pinned playlist \"%s\" not found", pin)
+	}
 	for i, item := range items {
-		playlistName := string(playlistIndexes[i+1]) // TODO check for out of range...
-		result = append(result, &Node{Name: playlistName, Label: playlistName + ") " + item.Name, ID: item.ID.String(), ExpandFunc: listPlaylistTracks})
+		result = append(result, a.playlistNode(playlistIndex(i+1), item))
 	}
 	return result, nil
 }
 
-func playlistKeyPress(n *Node, k string) {
+// playlistNode is the node of a playlist with the given index
+func (a *App) playlistNode(index string, item spotify.SimplePlaylist) *Node {
+	playlist := &playlistState{id: item.ID.String(), snapshot: item.SnapshotID, details: detailsOf(item)}
+	return &Node{Name: index, Label: index + ") " + item.Name, ID: item.ID.String(), Meta: map[string]interface{}{"playlist": playlist},
+		ExpandFunc: a.listPlaylistTracks, KeyPressFunc: a.playlistNodeKeyPress}
+}
+
+// findPlaylist is the playlist tree node with the given index, nil if there's none. It's only called from the UI
+// goroutine.
+func (a *App) findPlaylist(index string) *tview.TreeNode {
+	for _, tn := range a.playlists {
+		if tn.GetReference().(*Node).Name == index {
+			return tn
+		}
+	}
+	return nil
+}
+
+// playlistNodeKeyPress creates, edits, deletes and reorders playlists, "n" works on the liked tracks too
+func (a *App) playlistNodeKeyPress(n *Node, k string) {
+	switch k {
+	case "o":
+		if playlist, ok := n.Meta["playlist"].(*playlistState); ok {
+			a.toggleOrder(playlist)
+		}
+	case "n":
+		a.showPlaylistForm(nil, playlistDetails{Access: accessPrivate})
+	case "e", "d":
+		if n.ID == "" {
+			return
+		}
+		for _, tn := range a.playlists {
+			if tn.GetReference() != n {
+				continue
+			}
+			if k == "e" {
+				a.editPlaylist(tn)
+			} else {
+				a.confirm(fmt.Sprintf("Remove playlist \"%s\" from your library?", strings.TrimPrefix(n.Label, n.Name+") ")), func() {
+					a.deletePlaylist(tn)
+				})
+			}
+			return
+		}
+	}
+}
+
+// editPlaylist fetches the description of tn's playlist in the background, playlist listings don't have it, and then
+// pops up the form to edit it
+func (a *App) editPlaylist(tn *tview.TreeNode) {
+	playlist := tn.GetReference().(*Node).Meta["playlist"].(*playlistState)
+	details := playlist.describe()
+	go func() {
+		description, err := a.client.getPlaylistDescription(context.Background(), playlist.id)
+		a.tui.QueueUpdateDraw(func() {
+			if err != nil {
+				a.logger.Printf("unable to get the description of playlist \"%s\": %v", details.Name, err)
+				return
+			}
+			details.Description = description
+			a.showPlaylistForm(tn, details)
+		})
+	}()
+}
+
+// showPlaylistForm pops up a form to create a playlist with details, or to edit tn's if it isn't nil
+func (a *App) showPlaylistForm(tn *tview.TreeNode, details playlistDetails) {
+	if a.pages == nil {
+		return
+	}
+	title := "NEW PLAYLIST"
+	accesses := []string{accessPrivate, accessPublic, accessCollaborative}
+	if tn != nil {
+		title = "EDIT PLAYLIST"
+		// zmb3/spotify can't make an existing playlist collaborative or not
+		accesses = []string{accessPrivate, accessPublic}
+		if details.Access == accessCollaborative {
+			accesses = []string{accessCollaborative}
+		}
+	}
+	current := 0
+	for i, access := range accesses {
+		if access == details.Access {
+			current = i
+		}
+	}
+	name := tview.NewInputField().SetLabel("Name").SetText(details.Name).SetFieldWidth(40)
+	description := tview.NewInputField().SetLabel("Description").SetText(details.Description).SetFieldWidth(40)
+	access := tview.NewDropDown().SetLabel("Access").SetOptions(accesses, nil).SetCurrentOption(current)
+	form := tview.NewForm().AddFormItem(name).AddFormItem(description).AddFormItem(access)
+	form.SetBorder(true).SetTitle(title)
+
+	var closeForm func()
+	form.AddButton("Save", func() {
+		changed := playlistDetails{Name: strings.TrimSpace(name.GetText()), Description: description.GetText()}
+		_, changed.Access = access.GetCurrentOption()
+		if changed.Name == "" {
+			a.logger.Println("a playlist needs a name")
+			return
+		}
+		closeForm()
+		if tn == nil {
+			a.createPlaylist(changed)
+		} else {
+			a.changePlaylist(tn, changed)
+		}
+	})
+	form.AddButton("Cancel", func() {
+		closeForm()
+	})
+	form.SetCancelFunc(func() {
+		closeForm()
+	})
+	closeForm = a.showPopup(centered(form, 60, 11), form)
+}
+
+// createPlaylist creates a playlist in the background and adds it to the end of the tree with the next free index.
+// Like the other changes to playlists it's sent off the UI goroutine, so a slow or throttled request doesn't freeze
+// the TUI.
+func (a *App) createPlaylist(details playlistDetails) {
+	a.logger.Printf("creating playlist \"%s\"", details.Name)
+	go func() {
+		item, err := a.client.createPlaylist(context.Background(), details)
+		a.tui.QueueUpdateDraw(func() {
+			if err != nil {
+				a.logger.Println(err)
+				return
+			}
+			playlist := a.playlistNode(playlistIndex(a.nextPlaylist), item)
+			a.nextPlaylist++
+			playlist.Meta["playlist"].(*playlistState).changed(details)
+			tn := tview.NewTreeNode(playlist.Label).SetReference(playlist).SetSelectable(true)
+			a.playlistTree.GetRoot().AddChild(tn)
+			a.playlists = append(a.playlists, tn)
+			a.playlistTree.SetCurrentNode(tn)
+		})
+	}()
+}
+
+// changePlaylist renames tn's playlist and sets its description and access in the background, keeping its index
+func (a *App) changePlaylist(tn *tview.TreeNode, details playlistDetails) {
+	playlist := tn.GetReference().(*Node)
+	a.logger.Printf("changing playlist \"%s\"", playlist.Label)
+	go func() {
+		err := a.client.changePlaylist(context.Background(), playlist.ID, details)
+		a.tui.QueueUpdateDraw(func() {
+			if err != nil {
+				a.logger.Println(err)
+				return
+			}
+			playlist.Meta["playlist"].(*playlistState).changed(details)
+			playlist.Label = playlist.Name + ") " + details.Name
+			tn.SetText(playlist.Label)
+		})
+	}()
+}
+
+// deletePlaylist unfollows tn's playlist in the background, which deletes it if it's the user's own. The other
+// playlists keep their indexes.
+func (a *App) deletePlaylist(tn *tview.TreeNode) {
+	playlist := tn.GetReference().(*Node)
+	a.logger.Printf("deleting playlist \"%s\"", playlist.Label)
+	go func() {
+		err := a.client.deletePlaylist(context.Background(), playlist.ID)
+		a.tui.QueueUpdateDraw(func() {
+			if err != nil {
+				a.logger.Println(err)
+				return
+			}
+			for i, item := range a.playlists {
+				if item != tn {
+					continue
+				}
+				// the selection may have moved on while it was being deleted
+				selected := false
+				tn.Walk(func(node, parent *tview.TreeNode) bool {
+					selected = selected || node == a.playlistTree.GetCurrentNode()
+					return !selected
+				})
+				a.playlists = append(a.playlists[:i:i], a.playlists[i+1:]...)
+				a.playlistTree.GetRoot().RemoveChild(tn)
+				if selected {
+					if i == len(a.playlists) {
+						i--
+					}
+					a.playlistTree.SetCurrentNode(a.playlists[i])
+				}
+				return
+			}
+		})
+	}()
+}
+
+func (a *App) playlistKeyPress(n *Node, k string) {
 	switch k {
 	case "x":
+		if len(a.marks) > 0 {
+			a.removeNodes(a.markedNodes(n))
+			a.clearMarks()
+			return
+		}
 		if n.Meta == nil {
 			return
 		}
 		if playlistID, ok := n.Meta["playlistID"]; ok {
-			logger.Printf("removing track \"%s\" from playlist \"%s\"", n.Label, playlistID)
-			err := spoqClient.removeTrackFromPlaylist(playlistID.(string), n.ID)
+			a.logger.Printf("removing track \"%s\" from playlist \"%s\"", n.Label, playlistID)
+			done := func(removed []*Node, err error) {
+				if err != nil {
+					a.logger.Println(err)
+				}
+				a.showRemoved(removed)
+			}
+			if playlist, ok := n.Meta["playlist"].(*playlistState); ok {
+				// just this copy of the track
+				a.removeFromPlaylist(playlist, []*Node{n}, done)
+				return
+			}
+			go func() {
+				err := a.removeTrack(context.Background(), playlistID.(string), n.ID)
+				a.tui.QueueUpdateDraw(func() {
+					if err != nil {
+						done(nil, err)
+						return
+					}
+					done([]*Node{n}, nil)
+				})
+			}()
+		}
+	case playlistPickerKey:
+		a.showPlaylistPicker(a.markedTracks(n), false)
+	case "m":
+		a.showPlaylistPicker(a.markedTracks(n), true)
+	case moveUpKey, moveDownKey, moveTopKey, moveBottomKey:
+		a.moveTracks(n, k)
+	}
+}
+
+// keys moving tracks within a playlist listed in playlist order
+const (
+	moveUpKey     = "["
+	moveDownKey   = "]"
+	moveTopKey    = "{"
+	moveBottomKey = "}"
+)
+
+// moveTarget is the insertBefore that moves the tracks from first to last of count with k, -1 if they can't move
+func moveTarget(k string, first int, last int, count int) int {
+	switch {
+	case k == moveUpKey && first > 0:
+		return first - 1
+	case k == moveDownKey && last < count-1:
+		return last + 2
+	case k == moveTopKey && first > 0:
+		return 0
+	case k == moveBottomKey && last < count-1:
+		return count
+	}
+	return -1
+}
+
+// moveTracks moves the selected track, or the marked tracks next to it in playlist order if it's marked, up, down,
+// to the top or to the bottom of its playlist in the background
+func (a *App) moveTracks(n *Node, k string) {
+	playlist, ok := n.Meta["playlist"].(*playlistState)
+	if !ok {
+		return
+	}
+	if !playlist.ordered() {
+		a.logger.Println("press o on the playlist to list it in playlist order and move its tracks")
+		return
+	}
+	if playlist.isLoading() {
+		a.logger.Println(errLoading)
+		return
+	}
+	first, snapshot := playlist.position(n)
+	if first < 0 {
+		a.logger.Println(errRemoved)
+		return
+	}
+	last := first
+	tracks := playlist.tracks()
+	if a.marked(n) {
+		for first > 0 && a.marked(tracks[first-1]) {
+			first--
+		}
+		for last < len(tracks)-1 && a.marked(tracks[last+1]) {
+			last++
+		}
+	}
+	length := last - first + 1
+	insertBefore := moveTarget(k, first, last, len(tracks))
+	if insertBefore < 0 {
+		return
+	}
+	// the positions are only good until the next change, which waits for this one
+	if err := playlist.startChange(); err != nil {
+		a.logger.Println(err)
+		return
+	}
+	if first == last {
+		a.logger.Printf("moving track %d of playlist %s", first+1, playlist.id)
+	} else {
+		a.logger.Printf("moving tracks %d to %d of playlist %s", first+1, last+1, playlist.id)
+	}
+	go func() {
+		snapshot, err := a.client.reorderPlaylistTracks(context.Background(), playlist.id, snapshot, first, length, insertBefore)
+		if err == nil {
+			playlist.moved(first, length, insertBefore, snapshot)
+		}
+		playlist.endChange()
+		a.tui.QueueUpdateDraw(func() {
 			if err != nil {
-				logger.Println(err)
+				a.logger.Println(err)
 				return
 			}
-			n.Meta["color"] = tcell.ColorRed
+			// the selected track stays selected as it moves
+			if tn := a.playlistTreeNodeOf(playlist); tn != nil {
+				children := map[*Node]*tview.TreeNode{}
+				for _, child := range tn.GetChildren() {
+					children[child.GetReference().(*Node)] = child
+				}
+				ordered := []*tview.TreeNode{}
+				for _, track := range playlist.tracks() {
+					if child, ok := children[track]; ok {
+						ordered = append(ordered, child)
+					}
+				}
+				tn.SetChildren(ordered)
+			}
+		})
+	}()
+}
+
+// toggleOrder lists a playlist in playlist order or sorted, reloading it if it's expanded
+func (a *App) toggleOrder(playlist *playlistState) {
+	if playlist.toggleOrder() {
+		a.logger.Printf("listing playlist %s in playlist order", playlist.id)
+	} else {
+		a.logger.Printf("listing playlist %s sorted", playlist.id)
+	}
+	tn := a.playlistTreeNodeOf(playlist)
+	if tn == nil || len(tn.GetChildren()) == 0 || isLoading(tn) {
+		return
+	}
+	tn.ClearChildren()
+	a.playlistTree.SetCurrentNode(tn)
+	a.playlistTree.GetInputCapture()(tcell.NewEventKey(tcell.KeyRight, ' ', tcell.ModNone))
+}
+
+// playlistTreeNodeOf is the tree node of a playlist, nil if it's been deleted. It's only called from the UI
+// goroutine, like treeNodeOf.
+func (a *App) playlistTreeNodeOf(playlist *playlistState) *tview.TreeNode {
+	for _, tn := range a.playlists {
+		if tn.GetReference().(*Node).Meta["playlist"] == playlist {
+			return tn
 		}
 	}
+	return nil
 }
 
-func buildPlaylistTree() *tview.TreeView {
-	rootNode := &Node{Label: "My Playlists", ExpandFunc: listArtists}
+// treeNodeOf is the playlist tree node of n, nil if it's not in the tree
+func (a *App) treeNodeOf(n *Node) *tview.TreeNode {
+	var result *tview.TreeNode
+	a.playlistTree.GetRoot().Walk(func(node, parent *tview.TreeNode) bool {
+		if node.GetReference() == n {
+			result = node
+		}
+		return result == nil
+	})
+	return result
+}
+
+func (a *App) buildPlaylistTree() *tview.TreeView {
+	rootNode := &Node{Label: "My Playlists", ExpandFunc: a.listArtists}
 	treeRoot := tview.NewTreeNode(rootNode.Label).SetReference(rootNode).SetColor(tcell.ColorGreenYellow).SetSelectable(false)
 	tree := tview.NewTreeView().SetRoot(treeRoot).SetCurrentNode(treeRoot)
 	tree.SetBorder(true).SetTitle("PLAYLISTS")
-	playlists, _ := listPlaylists(rootNode)
+	playlists, _ := a.listPlaylists(context.Background(), rootNode, nil)
 	for _, playlist := range playlists {
-		treeRoot.AddChild(tview.NewTreeNode(playlist.Label).SetReference(playlist).SetSelectable(true))
+		tn := tview.NewTreeNode(playlist.Label).SetReference(playlist).SetSelectable(true)
+		treeRoot.AddChild(tn)
+		a.playlists = append(a.playlists, tn)
 	}
-	tree.SetInputCapture(treeKeyBindings(tree))
+	a.nextPlaylist = len(playlists)
+	a.playlistTree = tree
+	tree.SetInputCapture(a.treeKeyBindings(tree))
 	// listen for tracks being added
 	go func() {
-		for e := range playlistChan {
-			for _, playlistNode := range treeRoot.GetChildren() {
-				playlist := playlistNode.GetReference().(*Node)
-				if playlist.Name == e.PlaylistIndex {
-					logger.Printf("adding track \"%s\" to playlist \"%s\"", e.Track.Name, playlist.Label)
-					err := spoqClient.addTrackToPlaylist(playlist.ID, e.Track.ID)
-					if err != nil {
-						logger.Println(err)
-						return
-					}
-					newNode := tview.NewTreeNode(e.Track.Name).SetReference(e.Track).
-						SetSelectable(true).SetColor(tcell.ColorLightGreen)
-					app.QueueUpdateDraw(func() {
-						// expand playlist node
-						tree.SetCurrentNode(playlistNode)
-						f := tree.GetInputCapture()
-						f(tcell.NewEventKey(tcell.KeyRight, ' ', tcell.ModNone))
-						// add new node at the beginning and select it
-						children := playlistNode.GetChildren()
-						playlistNode.SetChildren(append([]*tview.TreeNode{newNode}, children...))
-						// playlistNode.AddChild(newNode)
-						tree.SetCurrentNode(newNode)
-					})
-					break
-				}
+		for e := range a.playlistChan {
+			added := true
+			for _, index := range e.PlaylistIndexes {
+				added = a.addToPlaylist(e.Tracks, index) && added
+			}
+			if e.Move && added {
+				a.tui.QueueUpdateDraw(func() {
+					a.removeNodes(e.Tracks)
+				})
 			}
 		}
 	}()
 	return tree
 }
+
+// addToPlaylist adds tracks to the playlist with the given index, telling whether they were added. It's called from
+// the playlist listener.
+func (a *App) addToPlaylist(tracks []*Node, index string) bool {
+	// playlists are created, renamed and deleted on the UI goroutine
+	var playlistNode *tview.TreeNode
+	var playlist Node
+	// and the tracks' Meta is changed there
+	saved := []spotify.SavedTrack{}
+	a.tui.QueueUpdate(func() {
+		if playlistNode = a.findPlaylist(index); playlistNode != nil {
+			playlist = *playlistNode.GetReference().(*Node)
+		}
+		for _, track := range tracks {
+			saved = append(saved, savedTrackOf(track))
+		}
+	})
+	if playlistNode == nil {
+		a.logger.Printf("no playlist %s", index)
+		return false
+	}
+	if len(tracks) == 1 {
+		a.logger.Printf("adding track \"%s\" to playlist \"%s\"", tracks[0].Name, playlist.Label)
+	} else {
+		a.logger.Printf("adding %d tracks to playlist \"%s\"", len(tracks), playlist.Label)
+	}
+	err := a.addTracks(context.Background(), playlist.ID, saved)
+	if err != nil {
+		a.logger.Println(err)
+		return false
+	}
+	state, _ := playlist.Meta["playlist"].(*playlistState)
+	added := []*Node{}
+	newNodes := []*tview.TreeNode{}
+	for i, track := range tracks {
+		n := &Node{Name: track.Name, Label: track.Name, ID: track.ID, KeyPressFunc: a.playlistKeyPress}
+		n.Meta = map[string]interface{}{"playlistID": playlist.ID, "track": saved[i].FullTrack}
+		if state != nil {
+			n.Meta["playlist"] = state
+			n.Meta["uri"] = "spotify:track:" + track.ID
+		}
+		added = append(added, n)
+		newNodes = append(newNodes, tview.NewTreeNode(track.Name).SetReference(n).SetSelectable(true).SetColor(tcell.ColorLightGreen))
+	}
+	a.tui.QueueUpdateDraw(func() {
+		tree := a.playlistTree
+		// expand playlist node
+		tree.SetCurrentNode(playlistNode)
+		loaded := len(playlistNode.GetChildren()) > 0 && !isLoading(playlistNode)
+		f := tree.GetInputCapture()
+		f(tcell.NewEventKey(tcell.KeyRight, ' ', tcell.ModNone))
+		if !loaded {
+			// the tracks arrive with the rest of the playlist
+			if state != nil {
+				state.added(nil)
+			}
+			return
+		}
+		if state != nil {
+			for _, n := range added {
+				state.added(n)
+			}
+		}
+		if state != nil && state.ordered() {
+			// they're added to the end of the playlist
+			for _, newNode := range newNodes {
+				playlistNode.AddChild(newNode)
+			}
+			tree.SetCurrentNode(newNodes[0])
+			return
+		}
+		// add new nodes at the beginning and select the first
+		children := playlistNode.GetChildren()
+		playlistNode.SetChildren(append(newNodes, children...))
+		tree.SetCurrentNode(newNodes[0])
+	})
+	return true
+}
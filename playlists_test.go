@@ -0,0 +1,38 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMoveTarget(t *testing.T) {
+	tests := []struct {
+		k           string
+		first, last int
+		want        string // "" when nothing moves
+	}{
+		{moveUpKey, 2, 2, "acbde"},
+		{moveUpKey, 1, 2, "bcade"},
+		{moveUpKey, 0, 1, ""},
+		{moveDownKey, 2, 2, "abdce"},
+		{moveDownKey, 0, 1, "cabde"},
+		{moveDownKey, 3, 4, ""},
+		{moveTopKey, 2, 3, "cdabe"},
+		{moveTopKey, 4, 4, "eabcd"},
+		{moveTopKey, 0, 0, ""},
+		{moveBottomKey, 1, 1, "acdeb"},
+		{moveBottomKey, 0, 2, "deabc"},
+		{moveBottomKey, 4, 4, ""},
+	}
+	items := strings.Split("abcde", "")
+	for _, test := range tests {
+		insertBefore := moveTarget(test.k, test.first, test.last, len(items))
+		got := ""
+		if insertBefore >= 0 {
+			got = strings.Join(reorder(items, test.first, test.last-test.first+1, insertBefore), "")
+		}
+		if got != test.want {
+			t.Errorf("expected %q moving %d to %d with %s, got %q", test.want, test.first, test.last, test.k, got)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"github.com/gdamore/tcell/v2"
+	"github.com/rivo/tview"
+)
+
+// showPopup shows p over the layout with focus on focus, returning the func that closes it. The app key bindings
+// are off while it's open, they'd take keys typed into it.
+func (a *App) showPopup(p tview.Primitive, focus tview.Primitive) func() {
+	previousCapture := a.tui.GetInputCapture()
+	previousFocus := a.tui.GetFocus()
+	a.tui.SetInputCapture(nil)
+	a.pages.AddPage("popup", p, true, true)
+	a.tui.SetFocus(focus)
+	return func() {
+		a.pages.RemovePage("popup")
+		a.tui.SetInputCapture(previousCapture)
+		a.tui.SetFocus(previousFocus)
+	}
+}
+
+// confirm asks a yes or no question, calling yes if the answer is yes
+func (a *App) confirm(question string, yes func()) {
+	modal := tview.NewModal().SetText(question).AddButtons([]string{"Yes", "No"})
+	// a modal centers itself
+	closeModal := a.showPopup(modal, modal)
+	modal.SetDoneFunc(func(buttonIndex int, buttonLabel string) {
+		// Esc gives -1
+		closeModal()
+		if buttonLabel == "Yes" {
+			yes()
+		}
+	})
+	modal.SetInputCapture(func(key *tcell.EventKey) *tcell.EventKey {
+		switch key.Rune() {
+		case 'y':
+			closeModal()
+			yes()
+			return nil
+		case 'n':
+			closeModal()
+			return nil
+		}
+		return key
+	})
+}
+
+// centered places p in the middle of the screen, at most width by height
+func centered(p tview.Primitive, width int, height int) tview.Primitive {
+	return tview.NewFlex().
+		AddItem(nil, 0, 1, false).
+		AddItem(tview.NewFlex().SetDirection(tview.FlexRow).
+			AddItem(nil, 0, 1, false).
+			AddItem(p, height, 1, true).
+			AddItem(nil, 0, 1, false), width, 1, true).
+		AddItem(nil, 0, 1, false)
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/rivo/tview"
+)
+
+const defaultProfileName = "default"
+
+// Profile is a named Spotify account with its own login, settings and cache
+type Profile struct {
+	Name string
+	// Dir holds the profile's token and config
+	Dir      string
+	CacheDir string
+	// tokenFile, if set, overrides where the token is saved by the file based token stores
+	tokenFile string
+}
+
+// profileRoots are the directories all profiles live under
+type profileRoots struct {
+	config string
+	cache  string
+}
+
+// defaultProfileRoots are spotui's directories under XDG_CONFIG_HOME and XDG_CACHE_HOME (or the platform equivalents)
+func defaultProfileRoots() (*profileRoots, error) {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return nil, err
+	}
+	cacheDir, err := defaultCacheDir()
+	if err != nil {
+		return nil, err
+	}
+	return &profileRoots{config: filepath.Join(configDir, "spotui", "profiles"), cache: cacheDir}, nil
+}
+
+// profile returns the named profile, creating its directory if needed
+func (r *profileRoots) profile(name string) (*Profile, error) {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return nil, fmt.Errorf("invalid profile name %q", name)
+	}
+	p := &Profile{Name: name, Dir: filepath.Join(r.config, name), CacheDir: filepath.Join(r.cache, name)}
+	err := os.MkdirAll(p.Dir, 0700)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create profile dir: %v", err)
+	}
+	return p, nil
+}
+
+// configFile is the config shared by all profiles
+func (r *profileRoots) configFile() string {
+	return filepath.Join(filepath.Dir(r.config), "config.toml")
+}
+
+// list returns the names of the profiles that exist, always including the default one
+func (r *profileRoots) list() ([]string, error) {
+	names := []string{defaultProfileName}
+	entries, err := ioutil.ReadDir(r.config)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() && entry.Name() != defaultProfileName {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names[1:])
+	return names, nil
+}
+
+// TokenFile is where the profile's OAuth token is saved by the plain file token store
+func (p *Profile) TokenFile() string {
+	if p.tokenFile != "" {
+		return p.tokenFile
+	}
+	return filepath.Join(p.Dir, "token.json")
+}
+
+// encryptedTokenFile is where the profile's OAuth token is saved by the encrypted file token store
+func (p *Profile) encryptedTokenFile() string {
+	if p.tokenFile != "" {
+		return p.tokenFile
+	}
+	return filepath.Join(p.Dir, "token.enc")
+}
+
+// adoptPlainToken moves a plain JSON token into store if it doesn't have one yet: the profile's own token.json,
+// or for the default profile one left in the working directory by older versions. That one isn't spotui's to
+// delete, so it's renamed to token.json.bak instead.
+func (p *Profile) adoptPlainToken(store TokenStore) error {
+	tok, err := store.Load()
+	if err != nil || tok != nil {
+		return err
+	}
+	plain := filepath.Join(p.Dir, "token.json")
+	paths := []string{plain}
+	if p.Name == defaultProfileName {
+		paths = append(paths, "token.json")
+	}
+	for _, path := range paths {
+		if file, ok := store.(*fileTokenStore); ok && file.path == path {
+			continue
+		}
+		tok, err := (&fileTokenStore{path: path}).Load()
+		if err != nil {
+			return err
+		}
+		if tok == nil || (tok.AccessToken == "" && tok.RefreshToken == "") {
+			// any JSON object reads as a token, e.g. OAuth client credentials
+			continue
+		}
+		err = store.Save(tok)
+		if err != nil {
+			return err
+		}
+		// it's safely in the store now, don't leave a plain copy behind
+		if path != plain {
+			return os.Rename(path, path+".bak")
+		}
+		return os.Remove(path)
+	}
+	return nil
+}
+
+// newProfilePicker lists the profiles, marking the current one, and calls pick with the one selected
+func newProfilePicker(names []string, current string, pick func(name string), cancel func()) *tview.List {
+	list := tview.NewList().ShowSecondaryText(false)
+	list.SetBorder(true).SetTitle("PROFILES")
+	selected := 0
+	for i, name := range names {
+		label := "  " + name
+		if name == current {
+			label = "* " + name
+			selected = i
+		}
+		name := name
+		list.AddItem(label, "", 0, func() {
+			pick(name)
+		})
+	}
+	list.SetCurrentItem(selected)
+	list.SetInputCapture(func(key *tcell.EventKey) *tcell.EventKey {
+		if key.Key() == tcell.KeyEsc {
+			cancel()
+			return nil
+		}
+		return key
+	})
+	return list
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// inTempDir runs the test in a new working directory
+func inTempDir(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.Chdir(wd)
+	})
+	return dir
+}
+
+func TestAdoptPlainTokenKeepsTheWorkingDirectoryOne(t *testing.T) {
+	dir := inTempDir(t)
+	roots := &profileRoots{config: filepath.Join(dir, "profiles"), cache: filepath.Join(dir, "cache")}
+	profile, err := roots.profile(defaultProfileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile("token.json", []byte(`{"access_token":"a","refresh_token":"r","token_type":"Bearer"}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &MemoryTokenStore{}
+	if err := profile.adoptPlainToken(store); err != nil {
+		t.Fatal(err)
+	}
+	tok, _ := store.Load()
+	if tok == nil || tok.RefreshToken != "r" {
+		t.Errorf("expected the token to be adopted, got %+v", tok)
+	}
+	if _, err := os.Stat("token.json"); !os.IsNotExist(err) {
+		t.Errorf("expected token.json to be renamed, got %v", err)
+	}
+	if _, err := os.Stat("token.json.bak"); err != nil {
+		t.Errorf("expected token.json.bak to be left, got %v", err)
+	}
+}
+
+func TestAdoptPlainTokenIgnoresOtherJSON(t *testing.T) {
+	dir := inTempDir(t)
+	roots := &profileRoots{config: filepath.Join(dir, "profiles"), cache: filepath.Join(dir, "cache")}
+	profile, err := roots.profile(defaultProfileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// e.g. OAuth client credentials
+	err = ioutil.WriteFile("token.json", []byte(`{"installed":{"client_id":"x"}}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &MemoryTokenStore{}
+	if err := profile.adoptPlainToken(store); err != nil {
+		t.Fatal(err)
+	}
+	if tok, _ := store.Load(); tok != nil {
+		t.Errorf("expected no token to be adopted, got %+v", tok)
+	}
+	if _, err := os.Stat("token.json"); err != nil {
+		t.Errorf("expected token.json to be left alone, got %v", err)
+	}
+}
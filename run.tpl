@@ -1,5 +1,4 @@
 #!/usr/bin/env bash
 
 export SPOTIFY_ID=""
-export SPOTIFY_SECRET=""
-go run *.go
\ No newline at end of file
+go run .
\ No newline at end of file
@@ -0,0 +1,479 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/zmb3/spotify"
+)
+
+// StubServer is a local stand-in for the Spotify Web API and Accounts service, serving a FakeLibrary
+type StubServer struct {
+	*httptest.Server
+	// RateLimitEvery makes every Nth API request fail with a 429 when > 0
+	RateLimitEvery int
+	library        *FakeLibrary
+	mu             sync.Mutex
+	requests       int
+	codes          map[string]string // authorization code -> PKCE code challenge
+	tokens         map[string]bool
+}
+
+// NewStubServer starts a StubServer for the provided library
+func NewStubServer(library *FakeLibrary) *StubServer {
+	s := &StubServer{library: library, codes: map[string]string{}, tokens: map[string]bool{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/authorize", s.authorize)
+	mux.HandleFunc("/api/token", s.token)
+	mux.HandleFunc("/v1/", s.api)
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+// APIURL is the base URL of the stand-in Web API
+func (s *StubServer) APIURL() string {
+	return s.URL + "/v1/"
+}
+
+// AccountsURL is the base URL of the stand-in Accounts service
+func (s *StubServer) AccountsURL() string {
+	return s.URL
+}
+
+func (s *StubServer) authorize(w http.ResponseWriter, r *http.Request) {
+	redirect, err := url.Parse(r.FormValue("redirect_uri"))
+	if err != nil || redirect.Host == "" {
+		http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+	if r.FormValue("client_id") == "" {
+		http.Error(w, "missing client_id", http.StatusBadRequest)
+		return
+	}
+	challenge := r.FormValue("code_challenge")
+	if challenge != "" && r.FormValue("code_challenge_method") != "S256" {
+		http.Error(w, "unsupported code_challenge_method", http.StatusBadRequest)
+		return
+	}
+	code := randStringBytes(20)
+	s.mu.Lock()
+	s.codes[code] = challenge
+	s.mu.Unlock()
+	q := redirect.Query()
+	q.Set("code", code)
+	q.Set("state", r.FormValue("state"))
+	redirect.RawQuery = q.Encode()
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+func (s *StubServer) token(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeStubError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	clientID, secret, ok := r.BasicAuth()
+	if !ok {
+		clientID, secret = r.FormValue("client_id"), r.FormValue("client_secret")
+	}
+	if clientID == "" {
+		writeStubError(w, http.StatusBadRequest, "invalid_client")
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch r.FormValue("grant_type") {
+	case "authorization_code":
+		code := r.FormValue("code")
+		challenge, ok := s.codes[code]
+		if !ok {
+			writeStubError(w, http.StatusBadRequest, "invalid_grant")
+			return
+		}
+		delete(s.codes, code)
+		// a public client proves it started the login with the code verifier, a confidential one with its secret
+		if challenge == "" && secret == "" {
+			writeStubError(w, http.StatusBadRequest, "invalid_client")
+			return
+		}
+		if challenge != "" && codeChallenge(r.FormValue("code_verifier")) != challenge {
+			writeStubError(w, http.StatusBadRequest, "invalid_grant")
+			return
+		}
+	case "refresh_token":
+		if !s.tokens[r.FormValue("refresh_token")] {
+			writeStubError(w, http.StatusBadRequest, "invalid_grant")
+			return
+		}
+	default:
+		writeStubError(w, http.StatusBadRequest, "unsupported_grant_type")
+		return
+	}
+	access := "access-" + randStringBytes(20)
+	refresh := "refresh-" + randStringBytes(20)
+	s.tokens[access] = true
+	s.tokens[refresh] = true
+	writeStubJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token":  access,
+		"token_type":    "Bearer",
+		"expires_in":    3600,
+		"refresh_token": refresh,
+		"scope":         r.FormValue("scope"),
+	})
+}
+
+func (s *StubServer) api(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.requests++
+	limited := s.RateLimitEvery > 0 && s.requests%s.RateLimitEvery == 0
+	authorized := s.tokens[strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")]
+	s.mu.Unlock()
+	if !authorized {
+		writeStubError(w, http.StatusUnauthorized, "The access token expired")
+		return
+	}
+	if limited {
+		w.Header().Set("Retry-After", "1")
+		writeStubError(w, http.StatusTooManyRequests, "API rate limit exceeded")
+		return
+	}
+
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/v1/"), "/"), "/")
+	route := r.Method + " " + parts[0]
+	if len(parts) == 5 {
+		route = r.Method + " " + parts[0] + "/{id}/" + parts[2] + "/{id}/" + parts[4]
+	} else if len(parts) == 3 {
+		route = r.Method + " " + parts[0] + "/{id}/" + parts[2]
+	} else if len(parts) == 2 && parts[0] == "playlists" {
+		route = r.Method + " " + parts[0] + "/{id}"
+	} else if len(parts) == 2 {
+		route = r.Method + " " + parts[0] + "/" + parts[1]
+	}
+	id := ""
+	if len(parts) == 5 {
+		id = parts[3]
+	} else if len(parts) > 1 {
+		id = parts[1]
+	}
+	f := s.library
+
+	switch route {
+	case "GET me":
+		writeStubJSON(w, http.StatusOK, map[string]interface{}{"id": f.UserID, "country": "US", "product": "premium"})
+	case "GET me/tracks":
+		items, _ := f.getAllSavedTracks(r.Context(), nil)
+		for i := range items {
+			inMarket(&items[i].FullTrack, r.FormValue("market"))
+		}
+		writeStubPage(w, r, items)
+	case "PUT me/tracks", "DELETE me/tracks":
+		ids := strings.Split(r.FormValue("ids"), ",")
+		if len(ids) > libraryBatchSize {
+			writeStubError(w, http.StatusBadRequest, "Too many ids requested")
+			return
+		}
+		for _, track := range ids {
+			var err error
+			if r.Method == http.MethodDelete {
+				err = f.removeTrackFromPlaylist(r.Context(), "", track)
+			} else {
+				err = f.addTrackToPlaylist(r.Context(), "", track)
+			}
+			if err != nil {
+				writeStubError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+		}
+		w.WriteHeader(http.StatusOK)
+	case "GET me/playlists":
+		f.mu.Lock()
+		items := append([]spotify.SimplePlaylist{}, f.Playlists...)
+		f.mu.Unlock()
+		writeStubPage(w, r, items)
+	case "POST users/{id}/playlists":
+		var body struct {
+			Name          string `json:"name"`
+			Public        bool   `json:"public"`
+			Description   string `json:"description"`
+			Collaborative bool   `json:"collaborative"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Name == "" {
+			writeStubError(w, http.StatusBadRequest, "Missing playlist name")
+			return
+		}
+		details := playlistDetails{Name: body.Name, Description: body.Description, Access: accessPrivate}
+		if body.Collaborative {
+			details.Access = accessCollaborative
+		} else if body.Public {
+			details.Access = accessPublic
+		}
+		playlist, err := f.createPlaylist(r.Context(), details)
+		if err != nil {
+			writeStubError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		writeStubJSON(w, http.StatusCreated, spotify.FullPlaylist{SimplePlaylist: playlist, Description: body.Description})
+	case "PUT playlists/{id}":
+		// like Spotify, only what's given is changed
+		var body struct {
+			Name        string  `json:"name"`
+			Public      *bool   `json:"public"`
+			Description *string `json:"description"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeStubError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		f.mu.Lock()
+		details, found := playlistDetails{}, false
+		for _, item := range f.Playlists {
+			if item.ID.String() == id {
+				details, found = detailsOf(item), true
+			}
+		}
+		f.mu.Unlock()
+		if !found {
+			writeStubError(w, http.StatusNotFound, "Not found")
+			return
+		}
+		if body.Name != "" {
+			details.Name = body.Name
+		}
+		if body.Description != nil {
+			details.Description = *body.Description
+		} else {
+			details.Description, _ = f.getPlaylistDescription(r.Context(), id)
+		}
+		if body.Public != nil && *body.Public {
+			details.Access = accessPublic
+		} else if body.Public != nil && details.Access == accessPublic {
+			details.Access = accessPrivate
+		}
+		if err := f.changePlaylist(r.Context(), id, details); err != nil {
+			writeStubError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	case "DELETE users/{id}/playlists/{id}/followers":
+		if err := f.deletePlaylist(r.Context(), id); err != nil {
+			writeStubError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	case "GET me/following":
+		items, _ := f.getAllFollowedArtists(r.Context())
+		s.writeCursorPage(w, r, items)
+	case "GET playlists/{id}":
+		description, err := f.getPlaylistDescription(r.Context(), id)
+		if err != nil {
+			writeStubError(w, http.StatusNotFound, "Not found")
+			return
+		}
+		f.mu.Lock()
+		playlist := spotify.FullPlaylist{Description: description}
+		for _, item := range f.Playlists {
+			if item.ID.String() == id {
+				playlist.SimplePlaylist = item
+			}
+		}
+		f.mu.Unlock()
+		writeStubJSON(w, http.StatusOK, playlist)
+	case "GET playlists/{id}/tracks":
+		items, _ := f.getAllSongsByPlaylist(r.Context(), id, nil)
+		for i := range items {
+			inMarket(&items[i].Track, r.FormValue("market"))
+		}
+		writeStubPage(w, r, items)
+	case "POST playlists/{id}/tracks", "DELETE playlists/{id}/tracks":
+		var body struct {
+			URIs       []string                `json:"uris"`
+			Tracks     []spotify.TrackToRemove `json:"tracks"`
+			SnapshotID string                  `json:"snapshot_id"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeStubError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if len(body.URIs)+len(body.Tracks) > playlistBatchSize {
+			writeStubError(w, http.StatusBadRequest, "Too many tracks requested")
+			return
+		}
+		if r.Method == http.MethodDelete && len(body.Tracks) > 0 && len(body.Tracks[0].Positions) > 0 {
+			snapshot, err := f.removeTracksFromPlaylistAt(r.Context(), id, body.SnapshotID, body.Tracks)
+			if err != nil {
+				writeStubError(w, http.StatusBadRequest, "Could not remove tracks, please check parameters: "+err.Error())
+				return
+			}
+			writeStubJSON(w, http.StatusOK, map[string]string{"snapshot_id": snapshot})
+			return
+		}
+		for _, t := range body.Tracks {
+			body.URIs = append(body.URIs, t.URI)
+		}
+		for _, uri := range body.URIs {
+			track := strings.TrimPrefix(uri, "spotify:track:")
+			var err error
+			if r.Method == http.MethodDelete {
+				err = f.removeTrackFromPlaylist(r.Context(), id, track)
+			} else {
+				err = f.addTrackToPlaylist(r.Context(), id, track)
+			}
+			if err != nil {
+				writeStubError(w, http.StatusNotFound, err.Error())
+				return
+			}
+		}
+		status := http.StatusOK
+		if r.Method == http.MethodPost {
+			status = http.StatusCreated
+		}
+		writeStubJSON(w, status, map[string]string{"snapshot_id": s.snapshotID(id)})
+	case "PUT playlists/{id}/tracks":
+		var body struct {
+			RangeStart   int    `json:"range_start"`
+			RangeLength  int    `json:"range_length"`
+			InsertBefore int    `json:"insert_before"`
+			SnapshotID   string `json:"snapshot_id"`
+		}
+		body.RangeLength = 1
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeStubError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		snapshot, err := f.reorderPlaylistTracks(r.Context(), id, body.SnapshotID, body.RangeStart, body.RangeLength, body.InsertBefore)
+		if err != nil {
+			writeStubError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		writeStubJSON(w, http.StatusOK, map[string]string{"snapshot_id": snapshot})
+	case "GET albums/{id}/tracks":
+		items, _ := f.getAllSongsByAlbum(r.Context(), id)
+		writeStubPage(w, r, items)
+	case "GET artists/{id}/albums":
+		items, _ := f.getAllAlbumsByArtist(r.Context(), id)
+		available := []spotify.SimpleAlbum{}
+		for _, item := range items {
+			// only what's available in the market, like Spotify
+			if playable(r.FormValue("market"), nil, item.AvailableMarkets) {
+				available = append(available, item)
+			}
+		}
+		writeStubPage(w, r, available)
+	case "GET artists/{id}/top-tracks":
+		if r.FormValue("country") == "" {
+			writeStubError(w, http.StatusBadRequest, "Missing country parameter")
+			return
+		}
+		items, _ := f.getPopularTracks(r.Context(), id)
+		for i := range items {
+			inMarket(&items[i], r.FormValue("country"))
+		}
+		writeStubJSON(w, http.StatusOK, map[string]interface{}{"tracks": items})
+	case "GET artists/{id}/related-artists":
+		items, _ := f.getRelatedArtists(r.Context(), id)
+		writeStubJSON(w, http.StatusOK, map[string]interface{}{"artists": items})
+	default:
+		writeStubError(w, http.StatusNotFound, "Service not found")
+	}
+}
+
+// inMarket reports a track the way Spotify does when a market is given: is_playable instead of available_markets
+func inMarket(track *spotify.FullTrack, market string) {
+	if market == "" {
+		return
+	}
+	ok := playable(market, nil, track.AvailableMarkets)
+	track.IsPlayable = &ok
+	track.AvailableMarkets = nil
+}
+
+func (s *StubServer) snapshotID(id string) string {
+	s.library.mu.Lock()
+	defer s.library.mu.Unlock()
+	return s.library.snapshotID(id)
+}
+
+// writeCursorPage writes followed artists the way /me/following pages them, using the last artist ID as the cursor
+func (s *StubServer) writeCursorPage(w http.ResponseWriter, r *http.Request, items []spotify.FullArtist) {
+	limit := queryInt(r, "limit", 20)
+	start := 0
+	if after := r.FormValue("after"); after != "" {
+		for i, item := range items {
+			if item.ID.String() == after {
+				start = i + 1
+			}
+		}
+	}
+	end := start + limit
+	if end > len(items) {
+		end = len(items)
+	}
+	page := items[start:end]
+	next, cursor := "", ""
+	if end < len(items) {
+		cursor = page[len(page)-1].ID.String()
+		next = nextPageURL(r, "after", cursor)
+	}
+	writeStubJSON(w, http.StatusOK, map[string]interface{}{
+		"artists": map[string]interface{}{
+			"items":   page,
+			"limit":   limit,
+			"total":   len(items),
+			"next":    next,
+			"cursors": map[string]string{"after": cursor},
+		},
+	})
+}
+
+// writeStubPage writes an offset paging object, with a next link when there are more items
+func writeStubPage[T any](w http.ResponseWriter, r *http.Request, items []T) {
+	limit := queryInt(r, "limit", 20)
+	offset := queryInt(r, "offset", 0)
+	if offset > len(items) {
+		offset = len(items)
+	}
+	end := offset + limit
+	if end > len(items) {
+		end = len(items)
+	}
+	next := ""
+	if end < len(items) {
+		next = nextPageURL(r, "offset", strconv.Itoa(end))
+	}
+	writeStubJSON(w, http.StatusOK, map[string]interface{}{
+		"items":  items[offset:end],
+		"limit":  limit,
+		"offset": offset,
+		"total":  len(items),
+		"next":   next,
+	})
+}
+
+func nextPageURL(r *http.Request, key string, value string) string {
+	q := r.URL.Query()
+	q.Set(key, value)
+	return fmt.Sprintf("http://%s%s?%s", r.Host, r.URL.Path, q.Encode())
+}
+
+func queryInt(r *http.Request, key string, def int) int {
+	v, err := strconv.Atoi(r.FormValue(key))
+	if err != nil {
+		return def
+	}
+	return v
+}
+
+func writeStubJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeStubError(w http.ResponseWriter, status int, message string) {
+	writeStubJSON(w, status, map[string]interface{}{"error": map[string]interface{}{"status": status, "message": message}})
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	crand "crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/oauth2"
+	"golang.org/x/term"
+)
+
+// token store kinds, see newTokenStore
+const (
+	tokenStoreAuto          = "auto"
+	tokenStoreSecretService = "secret-service"
+	tokenStoreEncrypted     = "encrypted"
+	tokenStoreFile          = "file"
+)
+
+// passphraseEnv is read for the encrypted token store's passphrase before prompting for it
+const passphraseEnv = "SPOTUI_TOKEN_PASSPHRASE"
+
+// newTokenStore creates the kind of token store for a profile. "auto" uses the Secret Service when it's
+// available and an encrypted file otherwise, the plain JSON "file" is only used when asked for.
+func newTokenStore(kind string, profile *Profile, passphrase func() ([]byte, error)) (TokenStore, error) {
+	switch kind {
+	case tokenStoreAuto:
+		if secretServiceAvailable() {
+			return newSecretServiceTokenStore(profile.Name), nil
+		}
+		return &encryptedFileTokenStore{path: profile.encryptedTokenFile(), passphrase: passphrase}, nil
+	case tokenStoreSecretService:
+		if !secretServiceAvailable() {
+			return nil, errors.New("the Secret Service is not available, is secret-tool installed and a keyring running?")
+		}
+		return newSecretServiceTokenStore(profile.Name), nil
+	case tokenStoreEncrypted:
+		return &encryptedFileTokenStore{path: profile.encryptedTokenFile(), passphrase: passphrase}, nil
+	case tokenStoreFile:
+		return &fileTokenStore{path: profile.TokenFile()}, nil
+	}
+	return nil, fmt.Errorf("unknown token store %q, use auto, secret-service, encrypted or file", kind)
+}
+
+// MemoryTokenStore keeps the token in memory only, e.g. for tests and the StubServer
+type MemoryTokenStore struct {
+	mu  sync.Mutex
+	tok *oauth2.Token
+}
+
+// Load returns a copy of the saved token
+func (s *MemoryTokenStore) Load() (*oauth2.Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.tok == nil {
+		return nil, nil
+	}
+	tok := *s.tok
+	return &tok, nil
+}
+
+// Save keeps a copy of the token
+func (s *MemoryTokenStore) Save(tok *oauth2.Token) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	saved := *tok
+	s.tok = &saved
+	return nil
+}
+
+// fileTokenStore keeps the token as plain JSON, readable only by the user
+type fileTokenStore struct {
+	path string
+}
+
+func (s *fileTokenStore) Load() (*oauth2.Token, error) {
+	b, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	tok := &oauth2.Token{}
+	err = json.Unmarshal(b, tok)
+	if err != nil {
+		return nil, fmt.Errorf("corrupt token file %s: %v", s.path, err)
+	}
+	return tok, nil
+}
+
+func (s *fileTokenStore) Save(tok *oauth2.Token) error {
+	b, err := json.Marshal(tok)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, b, 0600)
+}
+
+// encryptedFileTokenStore keeps the token encrypted with AES-GCM, using a key derived from a passphrase with scrypt
+type encryptedFileTokenStore struct {
+	path       string
+	passphrase func() ([]byte, error)
+}
+
+// encryptedToken is the on-disk form of an encryptedFileTokenStore
+type encryptedToken struct {
+	Salt  []byte `json:"salt"`
+	Nonce []byte `json:"nonce"`
+	Data  []byte `json:"data"`
+}
+
+func (s *encryptedFileTokenStore) Load() (*oauth2.Token, error) {
+	b, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	sealed := encryptedToken{}
+	err = json.Unmarshal(b, &sealed)
+	if err != nil {
+		return nil, fmt.Errorf("corrupt token file %s: %v", s.path, err)
+	}
+	aead, err := s.cipher(sealed.Salt)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := aead.Open(nil, sealed.Nonce, sealed.Data, nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decrypt %s, wrong passphrase?", s.path)
+	}
+	tok := &oauth2.Token{}
+	err = json.Unmarshal(plain, tok)
+	if err != nil {
+		return nil, fmt.Errorf("corrupt token file %s: %v", s.path, err)
+	}
+	return tok, nil
+}
+
+func (s *encryptedFileTokenStore) Save(tok *oauth2.Token) error {
+	plain, err := json.Marshal(tok)
+	if err != nil {
+		return err
+	}
+	sealed := encryptedToken{Salt: make([]byte, 16)}
+	if _, err := crand.Read(sealed.Salt); err != nil {
+		return err
+	}
+	aead, err := s.cipher(sealed.Salt)
+	if err != nil {
+		return err
+	}
+	sealed.Nonce = make([]byte, aead.NonceSize())
+	if _, err := crand.Read(sealed.Nonce); err != nil {
+		return err
+	}
+	sealed.Data = aead.Seal(nil, sealed.Nonce, plain, nil)
+	b, err := json.Marshal(sealed)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, b, 0600)
+}
+
+func (s *encryptedFileTokenStore) cipher(salt []byte) (cipher.AEAD, error) {
+	passphrase, err := s.passphrase()
+	if err != nil {
+		return nil, err
+	}
+	key, err := scrypt.Key(passphrase, salt, 1<<15, 8, 1, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// newPassphrase returns a func that reads the token passphrase from the environment, or prompts for it on the
+// terminal, the first time it's needed. It's remembered after that, so tokens refreshed while the TUI is running
+// can be saved without asking again. canPrompt, if not nil, tells whether the terminal is free to prompt on, it
+// isn't while the TUI runs.
+func newPassphrase(canPrompt func() bool) func() ([]byte, error) {
+	var mu sync.Mutex
+	var passphrase []byte
+	return func() ([]byte, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if passphrase != nil {
+			return passphrase, nil
+		}
+		if env := os.Getenv(passphraseEnv); env != "" {
+			passphrase = []byte(env)
+			return passphrase, nil
+		}
+		if !term.IsTerminal(int(os.Stdin.Fd())) {
+			return nil, fmt.Errorf("no passphrase for the encrypted token, set %s", passphraseEnv)
+		}
+		if canPrompt != nil && !canPrompt() {
+			return nil, fmt.Errorf("the passphrase for the encrypted token can't be asked for while spotui is running, set %s", passphraseEnv)
+		}
+		fmt.Fprint(os.Stderr, "Passphrase for the spotui token: ")
+		b, err := term.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return nil, err
+		}
+		if len(b) == 0 {
+			return nil, errors.New("empty passphrase")
+		}
+		passphrase = b
+		return passphrase, nil
+	}
+}
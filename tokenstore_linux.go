@@ -0,0 +1,75 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"golang.org/x/oauth2"
+)
+
+// secretServiceTokenStore keeps the token in the desktop keyring (GNOME Keyring, KWallet, ...) over the
+// freedesktop Secret Service D-Bus API, using libsecret's secret-tool
+type secretServiceTokenStore struct {
+	profile string
+}
+
+func newSecretServiceTokenStore(profile string) TokenStore {
+	return &secretServiceTokenStore{profile: profile}
+}
+
+// secretServiceAvailable tells whether secret-tool is installed and there's a session bus to reach the keyring on
+func secretServiceAvailable() bool {
+	if os.Getenv("DBUS_SESSION_BUS_ADDRESS") == "" {
+		return false
+	}
+	_, err := exec.LookPath("secret-tool")
+	return err == nil
+}
+
+func (s *secretServiceTokenStore) attributes() []string {
+	return []string{"service", "spotui", "profile", s.profile}
+}
+
+func (s *secretServiceTokenStore) Load() (*oauth2.Token, error) {
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	cmd := exec.Command("secret-tool", append([]string{"lookup"}, s.attributes()...)...)
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && stderr.Len() == 0 {
+		// secret-tool exits with 1 and says nothing when there's no matching secret
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("secret-tool lookup: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	tok := &oauth2.Token{}
+	err = json.Unmarshal(stdout.Bytes(), tok)
+	if err != nil {
+		return nil, fmt.Errorf("corrupt token in the keyring: %v", err)
+	}
+	return tok, nil
+}
+
+func (s *secretServiceTokenStore) Save(tok *oauth2.Token) error {
+	b, err := json.Marshal(tok)
+	if err != nil {
+		return err
+	}
+	stderr := &bytes.Buffer{}
+	args := append([]string{"store", "--label", "spotui token (" + s.profile + ")"}, s.attributes()...)
+	cmd := exec.Command("secret-tool", args...)
+	cmd.Stdin, cmd.Stderr = bytes.NewReader(b), stderr
+	err = cmd.Run()
+	if err != nil {
+		return fmt.Errorf("secret-tool store: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
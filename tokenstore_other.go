@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+// the Secret Service is a freedesktop API, other platforms fall back to the encrypted file
+
+func newSecretServiceTokenStore(profile string) TokenStore {
+	return nil
+}
+
+func secretServiceAvailable() bool {
+	return false
+}
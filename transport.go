@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// retryTransport is an http.RoundTripper that waits out rate limiting, retries idempotent requests that fail
+// with a 429 or 5xx using jittered exponential backoff, and caps the number of requests in flight
+type retryTransport struct {
+	base       http.RoundTripper
+	maxRetries int
+	baseDelay  time.Duration
+	maxDelay   time.Duration
+	inFlight   chan struct{}
+	// notify reports throttling state, e.g. to the LOG pane
+	notify func(message string)
+
+	mu          sync.Mutex
+	pausedUntil time.Time
+}
+
+func newRetryTransport(base http.RoundTripper, maxInFlight int, notify func(message string)) *retryTransport {
+	return &retryTransport{
+		base:       base,
+		maxRetries: 5,
+		baseDelay:  500 * time.Millisecond,
+		maxDelay:   30 * time.Second,
+		inFlight:   make(chan struct{}, maxInFlight),
+		notify:     notify,
+	}
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		if err := t.waitForPause(req); err != nil {
+			return nil, err
+		}
+		select {
+		case t.inFlight <- struct{}{}:
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+		resp, err := t.base.RoundTrip(req)
+		<-t.inFlight
+
+		throttled := err == nil && resp.StatusCode == http.StatusTooManyRequests
+		wait := t.backoff(attempt)
+		if err == nil {
+			if retryAfter, ok := parseRetryAfter(resp); ok {
+				wait = retryAfter
+			}
+		}
+		if wait > t.maxDelay {
+			// zmb3/spotify requests have no deadline, so nothing would cut a longer wait short
+			if throttled {
+				t.pause(t.maxDelay)
+			}
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+			return nil, fmt.Errorf("%s for %s asked to wait %v before retrying, longer than %v", resp.Status, req.URL.Path, wait, t.maxDelay)
+		}
+		if throttled {
+			// Spotify limits the whole app, so hold back every request until the window passes
+			t.pause(wait)
+		}
+		retryable := err != nil || throttled || resp.StatusCode >= http.StatusInternalServerError
+		if !retryable || !isIdempotent(req) || attempt >= t.maxRetries {
+			return resp, err
+		}
+		if err == nil {
+			// drain so the connection can be reused
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		reason := "request failed"
+		if err == nil {
+			reason = resp.Status
+		}
+		t.report(fmt.Sprintf("%s for %s, retrying in %v (%d/%d)", reason, req.URL.Path, wait.Round(time.Millisecond), attempt+1, t.maxRetries))
+		select {
+		case <-time.After(wait):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+}
+
+// backoff is a full-jitter exponential delay for the attempt
+func (t *retryTransport) backoff(attempt int) time.Duration {
+	d := t.baseDelay << uint(attempt)
+	if d <= 0 || d > t.maxDelay {
+		d = t.maxDelay
+	}
+	return time.Duration(rand.Int63n(int64(d))) + time.Millisecond
+}
+
+func (t *retryTransport) pause(d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if until := time.Now().Add(d); until.After(t.pausedUntil) {
+		t.pausedUntil = until
+		t.report(fmt.Sprintf("throttled by Spotify, pausing requests for %v", d.Round(time.Millisecond)))
+	}
+}
+
+func (t *retryTransport) waitForPause(req *http.Request) error {
+	t.mu.Lock()
+	wait := time.Until(t.pausedUntil)
+	t.mu.Unlock()
+	if wait <= 0 {
+		return nil
+	}
+	select {
+	case <-time.After(wait):
+		return nil
+	case <-req.Context().Done():
+		return req.Context().Err()
+	}
+}
+
+func (t *retryTransport) report(message string) {
+	if t.notify != nil {
+		t.notify(message)
+	}
+}
+
+func isIdempotent(req *http.Request) bool {
+	return req.Method == http.MethodGet || req.Method == http.MethodHead
+}
+
+// parseRetryAfter reads the Retry-After header, which Spotify sends in seconds
+func parseRetryAfter(resp *http.Response) (time.Duration, bool) {
+	seconds, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	if err != nil || seconds < 0 {
+		return 0, false
+	}
+	return time.Duration(seconds) * time.Second, true
+}
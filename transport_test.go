@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newStubClientConfig is a client config for a StubServer serving the fixture library, logging in on first use
+func newStubClientConfig(t *testing.T) (*StubServer, *SpotifyClientBuilderConfig) {
+	t.Helper()
+	fake, err := NewFakeLibraryFromFile("fixtures/library.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stub := NewStubServer(fake)
+	t.Cleanup(stub.Close)
+	config := DefaultSpotifyClientBuilderConfig()
+	useStubServer(stub, config)
+	config.TokenStore = &MemoryTokenStore{}
+	return stub, config
+}
+
+func TestRetryTransportWaitsOutRateLimiting(t *testing.T) {
+	stub, config := newStubClientConfig(t)
+	stub.RateLimitEvery = 2
+	var mu sync.Mutex
+	messages := []string{}
+	config.OnThrottle = func(message string) {
+		mu.Lock()
+		defer mu.Unlock()
+		messages = append(messages, message)
+	}
+	client, err := NewSpotifyClientBuilder(config).GetClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client.CurrentUser(); err != nil {
+		t.Fatal(err)
+	}
+	// the second request is limited, the retry after it isn't
+	start := time.Now()
+	user, err := client.CurrentUser()
+	if err != nil {
+		t.Fatalf("expected the limited request to be retried, got %v", err)
+	}
+	if user.ID != "fakeuser" {
+		t.Errorf("expected fakeuser, got %q", user.ID)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("expected the retry to wait for Retry-After (1s), it took %v", elapsed)
+	}
+	stub.mu.Lock()
+	requests := stub.requests
+	stub.mu.Unlock()
+	if requests != 3 {
+		t.Errorf("expected 3 API requests, got %d", requests)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(messages) == 0 || !strings.Contains(messages[0], "throttled by Spotify") {
+		t.Errorf("expected a throttling message, got %q", messages)
+	}
+}
+
+func TestRetryTransportGivesUpWaitingForASlotWhenCancelled(t *testing.T) {
+	transport := newRetryTransport(http.DefaultTransport, 1, nil)
+	// the one slot is taken
+	transport.inFlight <- struct{}{}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://127.0.0.1:1/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = transport.RoundTrip(req)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the deadline to be exceeded, got %v", err)
+	}
+}
+
+func TestRetryTransportGivesUpOnALongRetryAfter(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "3600")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+	transport := newRetryTransport(http.DefaultTransport, 1, nil)
+	req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	_, err = transport.RoundTrip(req)
+	if err == nil || !strings.Contains(err.Error(), "asked to wait 1h0m0s") {
+		t.Errorf("expected the request to give up, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected to give up straight away, it took %v", elapsed)
+	}
+	transport.mu.Lock()
+	paused := time.Until(transport.pausedUntil)
+	transport.mu.Unlock()
+	if paused > transport.maxDelay {
+		t.Errorf("expected the pause to be capped at %v, got %v", transport.maxDelay, paused)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"strings"
 
 	"github.com/gdamore/tcell/v2"
@@ -9,21 +10,22 @@ import (
 
 // Node represents a node in a tui tree
 type Node struct {
-	Name         string
-	Label        string
-	ID           string
-	Level        int
-	Meta         map[string]interface{}
-	ExpandFunc   func(n *Node) ([]*Node, error)
+	Name  string
+	Label string
+	ID    string
+	Level int
+	Meta  map[string]interface{}
+	// ExpandFunc lists the node's children, it can pass those listed so far to partial to show them ahead of the rest
+	ExpandFunc   func(ctx context.Context, n *Node, partial func(children []*Node)) ([]*Node, error)
 	KeyPressFunc func(n *Node, k string)
 }
 
-func buildTree(title string, rootName string) *tview.TreeView {
-	rootNode := &Node{Label: rootName, ExpandFunc: listArtists}
+func (a *App) buildTree(title string, rootName string) *tview.TreeView {
+	rootNode := &Node{Label: rootName, ExpandFunc: a.listArtists}
 	treeRoot := tview.NewTreeNode(rootNode.Label).SetReference(rootNode).SetColor(tcell.ColorGreenYellow).SetSelectable(false)
 	tree := tview.NewTreeView().SetRoot(treeRoot).SetCurrentNode(treeRoot)
 	tree.SetBorder(true).SetTitle(title)
-	tree.SetInputCapture(treeKeyBindings(tree))
+	tree.SetInputCapture(a.treeKeyBindings(tree))
 	return tree
 }
 
@@ -35,11 +37,73 @@ func setNodeColor(n *Node, tn *tview.TreeNode) {
 	}
 }
 
-func treeKeyBindings(tree *tview.TreeView) func(key *tcell.EventKey) *tcell.EventKey {
+// dimUnavailable shows a track node as not playable in the user's market
+func dimUnavailable(n *Node) {
+	if n.Meta == nil {
+		n.Meta = map[string]interface{}{}
+	}
+	n.Meta["color"] = tcell.ColorGray
+	n.Meta["unavailable"] = true
+}
+
+// loadingNode is the reference of the placeholder child shown while a node expands
+var loadingNode = &Node{Label: "loading…"}
+
+// isLoading tells whether a tree node is waiting for its children, or the rest of them
+func isLoading(tn *tview.TreeNode) bool {
+	children := tn.GetChildren()
+	return len(children) > 0 && children[len(children)-1].GetReference() == loadingNode
+}
+
+func newLoadingNode() *tview.TreeNode {
+	return tview.NewTreeNode(loadingNode.Label).SetReference(loadingNode).SetSelectable(false).SetColor(tcell.ColorGray)
+}
+
+// showChildren replaces the children of tn, keeping the tree nodes of those already shown so the selection stays
+// where it is. A placeholder is added after them if more are loading.
+func showChildren(tn *tview.TreeNode, children []*Node, loading bool) {
+	shown := map[*Node]*tview.TreeNode{}
+	for _, child := range tn.GetChildren() {
+		if n, ok := child.GetReference().(*Node); ok {
+			shown[n] = child
+		}
+	}
+	result := []*tview.TreeNode{}
+	for _, child := range children {
+		childNode, ok := shown[child]
+		if !ok {
+			childNode = tview.NewTreeNode(child.Label).SetReference(child).SetSelectable(true)
+			setNodeColor(child, childNode)
+		}
+		result = append(result, childNode)
+	}
+	if loading {
+		result = append(result, newLoadingNode())
+	}
+	tn.SetChildren(result)
+}
+
+// clearChildren removes the children of tn, selecting tn if one of them was selected
+func clearChildren(tree *tview.TreeView, tn *tview.TreeNode) {
+	for _, child := range tn.GetChildren() {
+		if child == tree.GetCurrentNode() {
+			tree.SetCurrentNode(tn)
+		}
+	}
+	tn.ClearChildren()
+}
+
+func (a *App) treeKeyBindings(tree *tview.TreeView) func(key *tcell.EventKey) *tcell.EventKey {
+	// expansions in progress, only touched from the UI goroutine
+	loading := map[*tview.TreeNode]context.CancelFunc{}
 	return func(key *tcell.EventKey) *tcell.EventKey {
 		if key.Key() == tcell.KeyRune {
-			selected := tree.GetCurrentNode().GetReference().(*Node)
 			k := string(key.Rune())
+			if a.markKeyPress(tree, k) {
+				a.setPlaylistPrefix("")
+				return nil
+			}
+			selected := tree.GetCurrentNode().GetReference().(*Node)
 			if selected.KeyPressFunc != nil {
 				// execute key press on selected node if a func is provided
 				selected.KeyPressFunc(selected, k)
@@ -47,12 +111,12 @@ func treeKeyBindings(tree *tview.TreeView) func(key *tcell.EventKey) *tcell.Even
 			} else if selected.Level == 1 {
 				// search top-level nodes
 				k := strings.ToUpper(k)
-				logger.Println("searching for items starting with " + k)
+				a.logger.Println("searching for items starting with " + k)
 				children := tree.GetRoot().GetChildren()
 				for _, child := range children {
 					n := child.GetReference().(*Node)
 					if strings.HasPrefix(n.Name, k) {
-						logger.Println("found " + n.Label)
+						a.logger.Println("found " + n.Label)
 						tree.SetCurrentNode(child)
 						return nil
 					}
@@ -60,6 +124,13 @@ func treeKeyBindings(tree *tview.TreeView) func(key *tcell.EventKey) *tcell.Even
 			}
 			return nil
 		}
+		// a playlist index is typed without moving in between, Esc just drops the start of one
+		if a.playlistPrefix != "" {
+			a.setPlaylistPrefix("")
+			if key.Key() == tcell.KeyEsc {
+				return nil
+			}
+		}
 		switch key.Key() {
 		case tcell.KeyLeft:
 			// collapse node
@@ -76,23 +147,58 @@ func treeKeyBindings(tree *tview.TreeView) func(key *tcell.EventKey) *tcell.Even
 				return nil
 			}
 			node := selected.GetReference().(*Node)
-			if node.ExpandFunc == nil {
-				return nil
-			}
-			children, err := node.ExpandFunc(node)
-			if err != nil {
-				logger.Println(err)
+			if node.ExpandFunc == nil || isLoading(selected) {
 				return nil
 			}
-			for _, child := range children {
-				childNode := tview.NewTreeNode(child.Label).SetReference(child).SetSelectable(true)
-				setNodeColor(child, childNode)
-				selected.AddChild(childNode)
-			}
+			// fetch the children off the UI goroutine, showing a placeholder until they arrive
+			ctx, cancel := context.WithCancel(context.Background())
+			loading[selected] = cancel
+			selected.AddChild(newLoadingNode())
 			selected.SetExpanded(true)
+			// children listed before the rest are shown as they come, until the expansion ends
+			partial := func(children []*Node) {
+				a.tui.QueueUpdateDraw(func() {
+					if ctx.Err() == nil {
+						showChildren(selected, children, true)
+					}
+				})
+			}
+			go func() {
+				children, err := node.ExpandFunc(ctx, node, partial)
+				a.tui.QueueUpdateDraw(func() {
+					if ctx.Err() != nil {
+						// cancelled with Esc, which has already cleared it up
+						return
+					}
+					cancel()
+					delete(loading, selected)
+					if err != nil {
+						// including any shown so far, they're listed again the next time it's expanded
+						clearChildren(tree, selected)
+						a.logger.Println(err)
+						return
+					}
+					showChildren(selected, children, false)
+				})
+			}()
 			return nil
 		case tcell.KeyEsc:
-			// collapse all nodes
+			// stop waiting for anything still loading, otherwise clear the marks, otherwise collapse all nodes
+			if len(loading) > 0 {
+				for tn, cancel := range loading {
+					// no more pages are fetched, but zmb3/spotify requests don't take a context: one already sent
+					// runs to the end in the background and what it returns is dropped
+					cancel()
+					delete(loading, tn)
+					clearChildren(tree, tn)
+					a.logger.Println("cancelled loading " + tn.GetReference().(*Node).Label)
+				}
+				return nil
+			}
+			if len(a.marks) > 0 {
+				a.clearMarks()
+				return nil
+			}
 			sel := tree.GetCurrentNode()
 			children := tree.GetRoot().GetChildren()
 			for _, child := range children {